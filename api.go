@@ -2,36 +2,74 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // caTime is a struct with only one member (time.Time) with an additional
-// UnmarshalJSON function so we can handle the two ways the CyberArk API
-// denotes time: with quotes such as "1543600800", or without, such as
-// 1543600800.
+// UnmarshalJSON function so we can handle the ways the CyberArk API denotes
+// time: as unix seconds with quotes such as "1543600800", or without, such as
+// 1543600800. Some versions use unix milliseconds or ISO8601 strings instead.
 type caTime struct {
 	time.Time
 }
 
+// maxUnixSeconds is the largest number taken as unix seconds. It lies in the
+// year 5138, while milliseconds passed it in 1973, so anything larger is
+// taken as milliseconds.
+const maxUnixSeconds = 1e11
+
+// isoLayouts are the ISO8601 layouts accepted for timestamps, tried in order.
+var isoLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+}
+
 func (m *caTime) UnmarshalJSON(b []byte) error {
 	s := string(b)
 	// remove double quotes, if any.
 	s = strings.TrimLeft(s, "\"")
 	s = strings.TrimRight(s, "\"")
-	i, err := strconv.Atoi(s)
+	i, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
+		for _, layout := range isoLayouts {
+			if t, perr := time.Parse(layout, s); perr == nil {
+				m.Time = t
+				return nil
+			}
+		}
 		return err
 	}
-	m.Time = time.Unix(int64(i), 0)
+	if i > maxUnixSeconds || i < -maxUnixSeconds {
+		m.Time = time.UnixMilli(i)
+		return nil
+	}
+	m.Time = time.Unix(i, 0)
 	return nil
 }
 
+// MarshalJSON denotes the time as unix seconds, like the CyberArk API does.
+func (m caTime) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatInt(m.Unix(), 10)), nil
+}
+
+// String formats the time as RFC3339, so it reads well in output and
+// templates.
+func (m caTime) String() string {
+	return m.Format(time.RFC3339)
+}
+
 // caLogonResponse contains the information after a successful login.
 type caLogonResponse struct {
 	CyberArkLogonResult string `json:"CyberArkLogonResult"`
@@ -39,14 +77,34 @@ type caLogonResponse struct {
 	ErrorMessage        string
 }
 
-// caLogonRequest contains the payload for logging in.
+// caLogonRequest contains the payload for logging in, except for the
+// password, which is added by logonPayload().
 type caLogonRequest struct {
 	Username                string `json:"username"`
-	Password                string `json:"password"`
 	UseRadiusAuthentication bool   `json:"useRadiusAuthentication"`
 	ConnectionNumber        int    `json:"connectionNumber"`
 }
 
+// logonPayload creates the JSON payload for logging in. The password is added
+// by hand, so encoding/json leaves no copies of it behind. The caller should
+// wipe the payload once sent.
+func logonPayload(p caLogonRequest, password *secret) ([]byte, error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	const key = `,"password":`
+	payload := make([]byte, 0, len(b)+len(key)+password.maxJSONLen())
+	payload = append(payload, b[:len(b)-1]...)
+	payload = append(payload, key...)
+	payload, err = password.appendJSON(payload)
+	if err != nil {
+		return nil, err
+	}
+	return append(payload, '}'), nil
+}
+
 // caIncomingRequestsResponse will be returned by caApi.IncomingRequests().
 type caIncomingRequestsResponse struct {
 	IncomingRequests []caIncomingRequest
@@ -58,11 +116,17 @@ type caIncomingRequestsResponse struct {
 type caIncomingRequest struct {
 	RequestID         string
 	RequestorUserName string
+	RequestorFullName string // Display name of the requestor, if known.
+	RequestorEmail    string // Email address of the requestor, if known.
 	UserReason        string
 	Operation         string
 	AccessFrom        caTime
 	AccessTo          caTime
 
+	// ConfirmReasonRequired is set when the safe policy demands a reason
+	// when confirming the request.
+	ConfirmReasonRequired bool
+
 	AccountDetails struct {
 		Properties struct {
 			Address      string
@@ -76,8 +140,39 @@ type caIncomingRequest struct {
 }
 
 // caConfirmRequest is request payload for the caAPI.Confirm() function.
+// The reason is left out when empty, since it's optional for most safes.
+// AccessTo overrides until when the access is granted, if set.
 type caConfirmRequest struct {
-	Reason string
+	Reason   string  `json:",omitempty"`
+	AccessTo *caTime `json:",omitempty"`
+}
+
+// caRejectRequest is the request payload for the caAPI.DenyRequest() function.
+type caRejectRequest struct {
+	Reason string `json:",omitempty"`
+}
+
+// caApproval is the outcome of a single incoming request handled by
+// caAPI.ApproveMatching().
+type caApproval struct {
+	Request  caIncomingRequest
+	Approved bool   // Whether the request was chosen to be approved.
+	Reason   string // The reason the request was confirmed with.
+	Err      error  // Non nil when confirming the request failed.
+
+	Duration time.Duration // How long confirming the request took.
+
+	// Only set by caAPI.ApproveRequestsPerUser(), when another request of
+	// the same requestor failed to confirm.
+	Aborted     bool  // The request was not confirmed at all.
+	RolledBack  bool  // The request was confirmed, but rejected afterwards.
+	RollbackErr error // Non nil when rejecting the confirmed request failed.
+}
+
+// caErrorResponse is the response of the vault when something went wrong.
+type caErrorResponse struct {
+	ErrorCode    string
+	ErrorMessage string
 }
 
 type caConfirmResponse struct {
@@ -86,100 +181,400 @@ type caConfirmResponse struct {
 }
 
 type caMyRequestsResponse struct {
-	errorCode    string `json:"ErrorCode"`
-	errorMessage string `json:"ErrorMessage"`
+	ErrorCode    string
+	ErrorMessage string
 	MyRequests   []caMyRequest
 }
 
+// Statuses of a request, as found in caMyRequest.Status.
+const (
+	caStatusWaiting   = 1
+	caStatusConfirmed = 2
+	caStatusRejected  = 3
+)
+
 type caMyRequest struct {
+	RequestID      string
 	Status         int
 	StatusTitle    string
 	AccountDetails struct {
 		AccountID  string
 		Properties struct {
 			Name string
+			Safe string
 		}
 	}
 }
 
+// caCreateRequest is the request payload for caAPI.CreateRequest().
+type caCreateRequest struct {
+	AccountID string `json:"AccountId"`
+	Reason    string
+}
+
+// caCreateResponse is the response of caAPI.CreateRequest(), which is the
+// created request itself.
+type caCreateResponse struct {
+	caMyRequest
+	ErrorCode    string
+	ErrorMessage string
+}
+
+// caServerInfo contains the version information of the PVWA, as returned by
+// caAPI.ServerInfo().
+type caServerInfo struct {
+	ServerName      string
+	ServerID        string
+	ExternalVersion string // The version, such as 10.6.0.
+	InternalVersion string // The build, such as 10.6.0.13.
+	ErrorCode       string
+	ErrorMessage    string
+}
+
+// caPlatform is a platform defined in the vault, as returned by
+// caAPI.Platforms().
+type caPlatform struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	SystemType string `json:"systemType"`
+	Active     bool   `json:"active"`
+}
+
+// caPlatformsResponse is the response of the platforms endpoint, which nests
+// the basic properties of every platform under "general".
+type caPlatformsResponse struct {
+	Platforms []struct {
+		General caPlatform `json:"general"`
+	}
+	ErrorCode    string
+	ErrorMessage string
+}
+
 // caAPI is the struct containing the state and functions for interacting with
-// a CyberArk password vault API.
+// a CyberArk password vault API. Once configured, a caAPI is safe for
+// concurrent use by multiple goroutines: the state that changes while using
+// the API is guarded by a mutex.
 type caAPI struct {
 	Client   http.Client // The HTTP client
-	Base     string      // Base URL of the PWV.
-	LogonKey string      // The Logon key, a long random string. Non empty if logged in.
+	Base     string      // Base URL of the PWV. Guarded by mu.
+	LogonKey string      // The Logon key, a long random string. Non empty if logged in. Guarded by mu.
+
+	// Fallbacks are the base URLs tried in order by Login when the vault at
+	// Base can't be reached. The first one which can be reached becomes the
+	// new Base.
+	Fallbacks []string
+
+	// GrantUntil overrides until when confirmed requests are granted access.
+	// When zero, the access window of the request itself is kept.
+	GrantUntil time.Time
+
+	// GrantDuration overrides how long confirmed requests are granted access,
+	// counting from the moment each one is confirmed. It takes precedence
+	// over GrantUntil.
+	GrantDuration time.Duration
+
+	// APIPrefix is the context path the PVWA is served under, such as
+	// "/PasswordVault", which is used when empty. Use "/" for the root.
+	APIPrefix string
+
+	// Headers are added to every request, except for headers already set on
+	// the request, such as Authorization.
+	Headers http.Header
+
+	// FailFast stops ApproveRequests at the first request which fails to
+	// confirm, instead of carrying on with the others.
+	FailFast bool
+
+	mu            sync.RWMutex
+	correlationID string  // The last correlation ID seen in a response. Guarded by mu.
+	stats         caStats // Guarded by mu.
+}
+
+// caStats sums up the API calls made by a caAPI.
+type caStats struct {
+	Calls      int            // Number of API calls, including failed ones
+	Bytes      int64          // Total size of the response bodies
+	Duration   time.Duration  // Total time spent on the calls
+	Operations map[string]int // Number of calls per operation
+}
+
+// correlationHeaders are the response headers which may contain an ID to
+// correlate a request with the logs of the vault, in order of preference.
+var correlationHeaders = []string{
+	"X-Cybr-Correlation-Id",
+	"X-Cybr-Request-Id",
+	"X-Correlation-Id",
+	"X-Request-Id",
+}
+
+// correlationID returns the correlation ID from the response headers. When
+// none of the well known headers is present, the value of the first X-Cybr-*
+// header (sorted by name) is used. An empty string is returned when there is
+// no such header at all.
+func correlationID(h http.Header) string {
+	for _, name := range correlationHeaders {
+		if v := h.Get(name); v != "" {
+			return v
+		}
+	}
+
+	var names []string
+	for name := range h {
+		if strings.HasPrefix(name, "X-Cybr-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if v := h.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// CorrelationID returns the last correlation ID sent by the vault, which
+// can be handed to the vault administrators when something fails.
+func (api *caAPI) CorrelationID() string {
+	api.mu.RLock()
+	defer api.mu.RUnlock()
+	return api.correlationID
+}
+
+// Stats returns the API calls made so far.
+func (api *caAPI) Stats() caStats {
+	api.mu.RLock()
+	defer api.mu.RUnlock()
+	stats := api.stats
+	stats.Operations = make(map[string]int, len(api.stats.Operations))
+	for op, n := range api.stats.Operations {
+		stats.Operations[op] = n
+	}
+	return stats
+}
+
+// do executes the request for the given operation, with the extra Headers,
+// and reads the complete response body. The correlation ID of the response,
+// if any, is remembered and the call is added to the stats.
+func (api *caAPI) do(operation string, req *http.Request) (*http.Response, []byte, error) {
+	start := time.Now()
+	var body []byte
+	defer func() {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		if api.stats.Operations == nil {
+			api.stats.Operations = make(map[string]int)
+		}
+		api.stats.Calls++
+		api.stats.Bytes += int64(len(body))
+		api.stats.Duration += time.Since(start)
+		api.stats.Operations[operation]++
+	}()
+
+	for name, values := range api.Headers {
+		if req.Header.Get(name) != "" {
+			continue
+		}
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+
+	httpResponse, err := api.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	if id := correlationID(httpResponse.Header); id != "" {
+		api.mu.Lock()
+		api.correlationID = id
+		api.mu.Unlock()
+	}
+
+	body, err = ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return httpResponse, nil, err
+	}
+	return httpResponse, body, nil
+}
+
+// responseError creates an error from the error code and message returned by
+// the vault, including the correlation ID of the response when there is one.
+func responseError(httpResponse *http.Response, code, message string) error {
+	return withCorrelationID(httpResponse, fmt.Sprintf("%s (%s)", code, message))
+}
+
+// statusError creates an error from the status of a response which came
+// without an error code, such as "unable to delete request 1: 500 Internal
+// Server Error", including the correlation ID of the response as well.
+func statusError(httpResponse *http.Response, format string, args ...interface{}) error {
+	return withCorrelationID(httpResponse, fmt.Sprintf(format, args...)+": "+httpResponse.Status)
+}
+
+// failedResponseError creates the error for a failed response, from the error
+// code in the body when there is one, or from the status otherwise.
+func failedResponseError(httpResponse *http.Response, body []byte, format string, args ...interface{}) error {
+	errResponse := caErrorResponse{}
+	if err := json.Unmarshal(body, &errResponse); err != nil || errResponse.ErrorCode == "" {
+		return statusError(httpResponse, format, args...)
+	}
+	return responseError(httpResponse, errResponse.ErrorCode, errResponse.ErrorMessage)
+}
+
+// withCorrelationID creates an error with the message, followed by the
+// correlation ID of the response when there is one.
+func withCorrelationID(httpResponse *http.Response, message string) error {
+	if id := correlationID(httpResponse.Header); id != "" {
+		return fmt.Errorf("%s [correlation ID: %s]", message, id)
+	}
+	return errors.New(message)
+}
+
+// logonKey returns the current logon key, which is empty when not logged in.
+func (api *caAPI) logonKey() string {
+	api.mu.RLock()
+	defer api.mu.RUnlock()
+	return api.LogonKey
+}
+
+// defaultAPIPrefix is the context path the PVWA is served under by default.
+const defaultAPIPrefix = "/PasswordVault"
+
+// apiPrefix returns the context path the PVWA is served under.
+func (api *caAPI) apiPrefix() string {
+	if api.APIPrefix == "" {
+		return defaultAPIPrefix
+	}
+	return strings.TrimRight(api.APIPrefix, "/")
+}
+
+// endpoint returns the complete URL of the given path at the vault, below the
+// API prefix.
+func (api *caAPI) endpoint(path string) string {
+	api.mu.RLock()
+	defer api.mu.RUnlock()
+	return api.Base + api.apiPrefix() + path
+}
+
+// newRequest creates a new HTTP request to the given URL, with the logon key
+// set as the Authorization header.
+func (api *caAPI) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", api.logonKey())
+	return req, nil
 }
 
 // Login logs the user in into the password vault given the username and password.
 // Internally - when succesful that is - the LogonKey will be set. The key will
-// be used to pass as Authorization header into subsequent requests.
-func (api *caAPI) Login(username, password string) error {
-	url := api.Base + "/PasswordVault/WebServices/auth/Cyberark/CyberArkAuthenticationService.svc/Logon"
+// be used to pass as Authorization header into subsequent requests. When the
+// vault can't be reached, the Fallbacks are tried in order. Any other error,
+// such as invalid credentials, stops at that vault.
+func (api *caAPI) Login(username string, password *secret) error {
+	api.mu.RLock()
+	bases := append([]string{api.Base}, api.Fallbacks...)
+	api.mu.RUnlock()
+
+	var err error
+	for _, base := range bases {
+		var reached bool
+		reached, err = api.login(base, username, password)
+		if reached {
+			if err == nil {
+				api.mu.Lock()
+				api.Base = base
+				api.mu.Unlock()
+			}
+			return err
+		}
+	}
+	return err
+}
+
+// login logs in at the vault with the given base URL. The boolean result
+// reports whether the vault could be reached and is serving, so there's no
+// point in trying another one.
+func (api *caAPI) login(base, username string, password *secret) (bool, error) {
+	url := base + api.apiPrefix() + "/WebServices/auth/Cyberark/CyberArkAuthenticationService.svc/Logon"
 
 	// Create the request as a struct, plus JSON marshaling.
 	p := caLogonRequest{
 		Username:                username,
-		Password:                password,
 		UseRadiusAuthentication: false,
 		ConnectionNumber:        1,
 	}
 
-	b, err := json.Marshal(p)
+	b, err := logonPayload(p, password)
 	if err != nil {
-		return fmt.Errorf("unable to unmarshal login request: %s", err)
+		return false, fmt.Errorf("unable to marshal login request: %s", err)
 	}
+	defer wipe(b)
 
-	httpResponse, err := api.Client.Post(url, "application/json", bytes.NewBuffer(b))
+	httpReq, err := http.NewRequest("POST", url, bytes.NewBuffer(b))
 	if err != nil {
-		return fmt.Errorf("unable to create a POST request to '%s': %s", url, err)
+		return false, err
 	}
-	defer httpResponse.Body.Close()
+	httpReq.Header.Set("Content-Type", "application/json")
 
-	// Read the response into a byte slice
-	body, err := ioutil.ReadAll(httpResponse.Body)
+	httpResponse, body, err := api.do("logon", httpReq)
 	if err != nil {
-		return fmt.Errorf("whoops")
+		return httpResponse != nil, fmt.Errorf("unable to POST the login request to '%s': %s", url, err)
 	}
 
-	// Unmarshal the response.
+	// A vault which isn't serving, such as a passive one behind a load
+	// balancer, answers with a server error or an HTML page instead. The next
+	// vault is tried for those, but not for authentication failures.
 	logonResult := caLogonResponse{}
-	err = json.Unmarshal(body, &logonResult)
-	if err != nil {
-		return err
+	if err := json.Unmarshal(body, &logonResult); err != nil {
+		return false, statusError(httpResponse, "unexpected response to the login request at '%s'", url)
 	}
-
 	if logonResult.ErrorCode != "" {
-		return fmt.Errorf("%s (%s)", logonResult.ErrorCode, logonResult.ErrorMessage)
+		return httpResponse.StatusCode < 500, responseError(httpResponse, logonResult.ErrorCode, logonResult.ErrorMessage)
+	}
+	if httpResponse.StatusCode >= 500 {
+		return false, statusError(httpResponse, "unable to login at '%s'", url)
 	}
 
+	api.mu.Lock()
 	api.LogonKey = logonResult.CyberArkLogonResult
+	api.mu.Unlock()
 
-	return nil
+	return true, nil
 }
 
 // Logout will log the user out. All that is required is the API LogonKey.
 // If no LogonKey exists (as in: it's an empty string), this function will
-// return an error.
+// return an error. Logging out of a session which already expired at the
+// server side (401 or 404) is considered successful.
 func (api *caAPI) Logout() error {
-	if api.LogonKey == "" {
+	if api.logonKey() == "" {
 		return fmt.Errorf("no logon key exists - unable to logout")
 	}
 
-	logoff := api.Base + "/PasswordVault/WebServices/auth/Cyberark/CyberArkAuthenticationService.svc/Logoff"
+	logoff := api.endpoint("/WebServices/auth/Cyberark/CyberArkAuthenticationService.svc/Logoff")
 
-	req, err := http.NewRequest("POST", logoff, nil)
+	req, err := api.newRequest("POST", logoff, nil)
 	if err != nil {
 		return err
 	}
 
-	// The response is not used when logging off.
-	req.Header.Add("Authorization", api.LogonKey)
-	_, err = api.Client.Do(req)
+	httpResponse, _, err := api.do("logoff", req)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	switch {
+	case httpResponse.StatusCode >= 200 && httpResponse.StatusCode < 300:
+		return nil
+	case httpResponse.StatusCode == http.StatusUnauthorized, httpResponse.StatusCode == http.StatusNotFound:
+		// The session is gone already, which is what we wanted anyway.
+		return nil
+	}
+
+	return statusError(httpResponse, "unexpected response while logging off")
 }
 
 // IncomingRequests will fetch the incoming requests which can be approved by
@@ -187,146 +582,582 @@ func (api *caAPI) Logout() error {
 func (api *caAPI) IncomingRequests() (caIncomingRequestsResponse, error) {
 	response := caIncomingRequestsResponse{}
 
-	if api.LogonKey == "" {
-		return response, fmt.Errorf("no logon key exists")
+	body, err := api.IncomingRequestsRaw()
+	if err != nil {
+		return response, err
 	}
 
-	url := api.Base + "/PasswordVault/API/IncomingRequests"
-	httpReq, err := http.NewRequest("GET", url, nil)
+	err = json.Unmarshal(body, &response)
 	if err != nil {
 		return response, err
 	}
 
-	httpReq.Header.Add("Authorization", api.LogonKey)
+	return response, nil
+}
+
+// IncomingRequestsRaw returns the body of the incoming requests response as
+// it was sent by the vault, without decoding it.
+func (api *caAPI) IncomingRequestsRaw() ([]byte, error) {
+	if api.logonKey() == "" {
+		return nil, fmt.Errorf("no logon key exists")
+	}
+
+	url := api.endpoint("/API/IncomingRequests")
+	httpReq, err := api.newRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	query := httpReq.URL.Query()
 	query.Add("onlywaiting", "true")
 	query.Add("expired", "false")
 	httpReq.URL.RawQuery = query.Encode()
 
-	httpResponse, err := api.Client.Do(httpReq)
-	if err != nil {
-		return response, err
-	}
-	defer httpResponse.Body.Close()
-
-	bytes, err := ioutil.ReadAll(httpResponse.Body)
+	httpResponse, body, err := api.do("incoming-requests", httpReq)
 	if err != nil {
-		return response, err
+		return nil, err
 	}
-
-	err = json.Unmarshal(bytes, &response)
-	if err != nil {
-		return response, err
+	if httpResponse.StatusCode/100 != 2 {
+		return nil, failedResponseError(httpResponse, body, "unable to get the incoming requests")
 	}
-
-	return response, nil
+	return body, nil
 }
 
 // ConfirmRequest will attempt to confirm the given request. The RequestID
-// is used for uniquely identifying the request for approval.
+// is used for uniquely identifying the request for approval. If the safe
+// requires a reason but none is given, the request is not sent at all. When
+// GrantDuration or GrantUntil is set, the access is granted for that long or
+// until then.
 func (api *caAPI) ConfirmRequest(r caIncomingRequest, reason string) error {
-	url := api.Base + "/PasswordVault/API/IncomingRequests/" + r.RequestID + "/Confirm"
+	if r.ConfirmReasonRequired && reason == "" {
+		return fmt.Errorf("a reason is mandatory for confirming requests on safe '%s'", r.AccountDetails.Properties.Safe)
+	}
+
+	url := api.endpoint("/API/IncomingRequests/" + r.RequestID + "/Confirm")
 
 	payload := caConfirmRequest{
 		Reason: reason,
 	}
+	if api.GrantDuration > 0 {
+		payload.AccessTo = &caTime{time.Now().Add(api.GrantDuration)}
+	} else if !api.GrantUntil.IsZero() {
+		payload.AccessTo = &caTime{api.GrantUntil}
+	}
 
 	b, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("unable to unmarshal confirm request: %s", err)
 	}
 
-	httpReq, err := http.NewRequest("POST", url, bytes.NewBuffer(b))
+	httpReq, err := api.newRequest("POST", url, bytes.NewBuffer(b))
 	if err != nil {
 		return err
 	}
-	httpReq.Header.Set("Authorization", api.LogonKey)
 	httpReq.Header.Set("Content-Type", "application/json")
-	httpResp, err := api.Client.Do(httpReq)
+	httpResp, respBody, err := api.do("confirm", httpReq)
 	if err != nil {
 		return err
 	}
-	defer httpResp.Body.Close()
 
 	if httpResp.StatusCode == 200 {
 		return nil
 	}
 
-	respBody, err := ioutil.ReadAll(httpResp.Body)
-	if err != nil {
-		return err
-	}
-
 	confirmResponse := caConfirmResponse{}
 	err = json.Unmarshal(respBody, &confirmResponse)
 	if err != nil {
 		return err
 	}
 	if confirmResponse.ErrorCode != "" {
-		return fmt.Errorf("%s (%s)", confirmResponse.ErrorCode, confirmResponse.ErrorMessage)
+		return responseError(httpResp, confirmResponse.ErrorCode, confirmResponse.ErrorMessage)
 	}
 
 	return nil
 }
 
+// ApproveMatching fetches the incoming requests and calls decide for each of
+// them, see ApproveRequests.
+func (api *caAPI) ApproveMatching(ctx context.Context, decide func(caIncomingRequest) (bool, string, error)) ([]caApproval, error) {
+	incomingRequests, err := api.IncomingRequests()
+	if err != nil {
+		return nil, err
+	}
+	return api.ApproveRequests(ctx, incomingRequests.IncomingRequests, decide)
+}
+
+// ApproveRequests calls decide for each of the given requests. Requests for
+// which decide returns true are confirmed using the returned reason, the
+// others are skipped. A failed confirmation is recorded in the result and
+// does not stop the other requests from being handled, unless FailFast is
+// set. An error returned by decide does stop: in that case the results so far
+// are returned together with the error.
+func (api *caAPI) ApproveRequests(ctx context.Context, requests []caIncomingRequest, decide func(caIncomingRequest) (bool, string, error)) ([]caApproval, error) {
+	var results []caApproval
+	for _, r := range requests {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+
+		approve, reason, err := decide(r)
+		if err != nil {
+			return results, fmt.Errorf("unable to decide on request %s: %s", r.RequestID, err)
+		}
+
+		result := caApproval{Request: r, Approved: approve, Reason: reason}
+		if approve {
+			start := time.Now()
+			result.Err = api.ConfirmRequest(r, reason)
+			result.Duration = time.Since(start)
+		}
+		results = append(results, result)
+
+		if result.Err != nil && api.FailFast {
+			return results, fmt.Errorf("stopped after request %s failed to confirm: %s", r.RequestID, result.Err)
+		}
+	}
+
+	return results, nil
+}
+
+// ApproveRequestsPerUser works like ApproveRequests, but approves the
+// requests of a requestor all or nothing. Once a confirmation fails, the
+// remaining requests of that requestor are aborted, and the ones confirmed
+// already are rolled back by rejecting them with rollbackReason. Requests
+// are grouped by the user name of the requestor after applying fold. The
+// results are in the order of the given requests.
+func (api *caAPI) ApproveRequestsPerUser(ctx context.Context, requests []caIncomingRequest, decide func(caIncomingRequest) (bool, string, error), fold func(string) string, rollbackReason string) ([]caApproval, error) {
+	results := make([]caApproval, 0, len(requests))
+	for _, r := range requests {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+
+		approve, reason, err := decide(r)
+		if err != nil {
+			return results, fmt.Errorf("unable to decide on request %s: %s", r.RequestID, err)
+		}
+		results = append(results, caApproval{Request: r, Approved: approve, Reason: reason})
+	}
+
+	var order []string
+	groups := make(map[string][]int)
+	for i, res := range results {
+		if !res.Approved {
+			continue
+		}
+		user := fold(res.Request.RequestorUserName)
+		if _, ok := groups[user]; !ok {
+			order = append(order, user)
+		}
+		groups[user] = append(groups[user], i)
+	}
+
+	// done returns the results, leaving out the requests of the requestors
+	// which weren't handled yet.
+	handled := make(map[string]bool)
+	done := func() []caApproval {
+		var done []caApproval
+		for _, res := range results {
+			if !res.Approved || handled[fold(res.Request.RequestorUserName)] {
+				done = append(done, res)
+			}
+		}
+		return done
+	}
+
+	for _, user := range order {
+		if err := ctx.Err(); err != nil {
+			return done(), err
+		}
+		failed := api.approveGroup(results, groups[user], rollbackReason)
+		handled[user] = true
+		if failed != nil && api.FailFast {
+			return done(), fmt.Errorf("stopped after request %s failed to confirm: %s", failed.Request.RequestID, failed.Err)
+		}
+	}
+
+	return results, nil
+}
+
+// approveGroup confirms the results at the given indexes, rolling back the
+// confirmed ones when any of them fails. The failed result is returned, if
+// any.
+func (api *caAPI) approveGroup(results []caApproval, group []int, rollbackReason string) *caApproval {
+	for n, i := range group {
+		res := &results[i]
+		start := time.Now()
+		res.Err = api.ConfirmRequest(res.Request, res.Reason)
+		res.Duration = time.Since(start)
+		if res.Err == nil {
+			continue
+		}
+
+		for _, j := range group[n+1:] {
+			results[j].Aborted = true
+		}
+		for _, j := range group[:n] {
+			results[j].RollbackErr = api.DenyRequest(results[j].Request, rollbackReason)
+			results[j].RolledBack = results[j].RollbackErr == nil
+		}
+		return res
+	}
+	return nil
+}
+
+// DenyRequest rejects the given incoming request with the given reason.
+func (api *caAPI) DenyRequest(r caIncomingRequest, reason string) error {
+	url := api.endpoint("/API/IncomingRequests/" + r.RequestID + "/Reject")
+
+	b, err := json.Marshal(caRejectRequest{Reason: reason})
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := api.newRequest("POST", url, bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpResp, respBody, err := api.do("reject", httpReq)
+	if err != nil {
+		return err
+	}
+
+	if httpResp.StatusCode == 200 {
+		return nil
+	}
+
+	errResponse := caErrorResponse{}
+	if err := json.Unmarshal(respBody, &errResponse); err != nil || errResponse.ErrorCode == "" {
+		return statusError(httpResp, "unable to reject request %s", r.RequestID)
+	}
+	return responseError(httpResp, errResponse.ErrorCode, errResponse.ErrorMessage)
+}
+
 func (api *caAPI) MyRequests() (caMyRequestsResponse, error) {
-	url := api.Base + "/PasswordVault/API/MyRequests"
+	httpResponse, respBody, err := api.myRequests()
+	if err != nil {
+		return caMyRequestsResponse{}, err
+	}
 
-	httpReq, err := http.NewRequest("GET", url, nil)
+	myReqs := caMyRequestsResponse{}
+	err = json.Unmarshal(respBody, &myReqs)
 	if err != nil {
 		return caMyRequestsResponse{}, err
 	}
-	httpReq.Header.Set("Authorization", api.LogonKey)
+	if myReqs.ErrorCode != "" {
+		return caMyRequestsResponse{}, responseError(httpResponse, myReqs.ErrorCode, myReqs.ErrorMessage)
+	}
+
+	return myReqs, nil
+}
+
+// MyRequestsRaw returns the body of the own requests response as it was
+// sent by the vault, without decoding it.
+func (api *caAPI) MyRequestsRaw() ([]byte, error) {
+	_, body, err := api.myRequests()
+	return body, err
+}
+
+func (api *caAPI) myRequests() (*http.Response, []byte, error) {
+	url := api.endpoint("/API/MyRequests")
+
+	httpReq, err := api.newRequest("GET", url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	query := httpReq.URL.Query()
 	query.Add("onlywaiting", "false")
 	query.Add("expired", "false")
 	httpReq.URL.RawQuery = query.Encode()
 
-	httpResponse, err := api.Client.Do(httpReq)
+	httpResponse, body, err := api.do("my-requests", httpReq)
 	if err != nil {
-		return caMyRequestsResponse{}, err
+		return httpResponse, nil, err
 	}
-	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode/100 != 2 {
+		return httpResponse, nil, failedResponseError(httpResponse, body, "unable to get my requests")
+	}
+	return httpResponse, body, nil
+}
 
-	respBody, err := ioutil.ReadAll(httpResponse.Body)
+// CreateRequest requests access to the account with the given ID, which has
+// to be confirmed by others before the password can be retrieved.
+func (api *caAPI) CreateRequest(accountID, reason string) (caMyRequest, error) {
+	url := api.endpoint("/API/MyRequests")
+
+	payload := caCreateRequest{
+		AccountID: accountID,
+		Reason:    reason,
+	}
+
+	b, err := json.Marshal(payload)
 	if err != nil {
-		return caMyRequestsResponse{}, err
+		return caMyRequest{}, fmt.Errorf("unable to marshal create request: %s", err)
 	}
 
-	myReqs := caMyRequestsResponse{}
-	err = json.Unmarshal(respBody, &myReqs)
+	httpReq, err := api.newRequest("POST", url, bytes.NewBuffer(b))
 	if err != nil {
-		return caMyRequestsResponse{}, err
+		return caMyRequest{}, err
 	}
-	if myReqs.errorCode != "" {
-		return caMyRequestsResponse{}, fmt.Errorf("%s (%s)", myReqs.errorCode, myReqs.errorMessage)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResponse, body, err := api.do("create-request", httpReq)
+	if err != nil {
+		return caMyRequest{}, err
 	}
 
-	return myReqs, nil
+	created := caCreateResponse{}
+	err = json.Unmarshal(body, &created)
+	if err != nil {
+		return caMyRequest{}, err
+	}
+	if created.ErrorCode != "" {
+		return caMyRequest{}, responseError(httpResponse, created.ErrorCode, created.ErrorMessage)
+	}
+
+	return created.caMyRequest, nil
+}
+
+// DeleteMyRequest withdraws one of my own requests which is no longer needed.
+func (api *caAPI) DeleteMyRequest(requestID string) error {
+	url := api.endpoint("/API/MyRequests/" + requestID)
+
+	httpReq, err := api.newRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+
+	httpResponse, body, err := api.do("delete-request", httpReq)
+	if err != nil {
+		return err
+	}
+
+	if httpResponse.StatusCode == http.StatusOK || httpResponse.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	errResponse := caErrorResponse{}
+	if err := json.Unmarshal(body, &errResponse); err != nil || errResponse.ErrorCode == "" {
+		return statusError(httpResponse, "unable to delete request %s", requestID)
+	}
+	return responseError(httpResponse, errResponse.ErrorCode, errResponse.ErrorMessage)
+}
+
+// caErrPasswordChanging is the error code returned when retrieving a password
+// while the CPM is in the middle of changing it.
+const caErrPasswordChanging = "ITATS542I"
+
+// caErrReasonRequired is the error code returned when retrieving a password
+// without a reason, for accounts which require one.
+const caErrReasonRequired = "ITATS525E"
+
+// rotationRetries is how many times retrieving a password is retried while it
+// is being changed, waiting rotationBackoff (doubled after every attempt)
+// in between.
+var (
+	rotationRetries = 3
+	rotationBackoff = 2 * time.Second
+)
+
+// GetPassword retrieves the password of the account the request is for. When
+// the password is being changed by the CPM, retrieving it is retried a few
+// times, since the change usually completes shortly. When the account demands
+// a reason for retrieving the password, the given reason is used. It's an
+// error if the reason is empty in that case. The caller should destroy the
+// password once used.
+func (api *caAPI) GetPassword(req caMyRequest, reason string) (*secret, error) {
+	backoff := rotationBackoff
+	for attempt := 0; ; attempt++ {
+		passwd, code, err := api.getPassword(req, reason)
+		if code != caErrPasswordChanging || attempt >= rotationRetries {
+			return passwd, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
 }
 
-func (api *caAPI) GetPassword(req caMyRequest) (string, error) {
+// getPassword does a single attempt at retrieving the password. When the
+// vault returns an error, its error code is returned too.
+func (api *caAPI) getPassword(req caMyRequest, reason string) (*secret, string, error) {
 	accID := req.AccountDetails.AccountID
-	url := api.Base + "/PasswordVault/WebServices/PIMServices.svc/Accounts/" + accID + "/Credentials"
+	url := api.endpoint("/WebServices/PIMServices.svc/Accounts/" + accID + "/Credentials")
 
-	httpReq, err := http.NewRequest("GET", url, nil)
+	httpReq, err := api.newRequest("GET", url, nil)
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
-	httpReq.Header.Set("Authorization", api.LogonKey)
 
-	httpResponse, err := api.Client.Do(httpReq)
+	httpResponse, body, err := api.do("get-password", httpReq)
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
-	defer httpResponse.Body.Close()
 
-	bytes, err := ioutil.ReadAll(httpResponse.Body)
+	if httpResponse.StatusCode != http.StatusOK {
+		errResponse := caErrorResponse{}
+		if err := json.Unmarshal(body, &errResponse); err != nil || errResponse.ErrorCode == "" {
+			return nil, "", statusError(httpResponse, "unable to retrieve the password")
+		}
+		if errResponse.ErrorCode == caErrReasonRequired {
+			if reason == "" {
+				return nil, errResponse.ErrorCode, fmt.Errorf("account %s requires a reason to retrieve the password, supply one using -reason", accID)
+			}
+			return api.RetrievePassword(accID, reason)
+		}
+		return nil, errResponse.ErrorCode, responseError(httpResponse, errResponse.ErrorCode, errResponse.ErrorMessage)
+	}
+
+	return newSecret(body), "", nil
+}
+
+// caRetrieveRequest is the request payload for caAPI.RetrievePassword().
+type caRetrieveRequest struct {
+	Reason string `json:"reason"`
+}
+
+// RetrievePassword retrieves the password of the account with the given ID,
+// stating the reason for it. Like GetPassword, the error code is returned
+// when the vault returns an error.
+func (api *caAPI) RetrievePassword(accountID, reason string) (*secret, string, error) {
+	url := api.endpoint("/API/Accounts/" + accountID + "/Password/Retrieve")
+
+	b, err := json.Marshal(caRetrieveRequest{Reason: reason})
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to marshal retrieve request: %s", err)
+	}
+
+	httpReq, err := api.newRequest("POST", url, bytes.NewBuffer(b))
+	if err != nil {
+		return nil, "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResponse, body, err := api.do("retrieve-password", httpReq)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if httpResponse.StatusCode != http.StatusOK {
+		errResponse := caErrorResponse{}
+		if err := json.Unmarshal(body, &errResponse); err != nil || errResponse.ErrorCode == "" {
+			return nil, "", statusError(httpResponse, "unable to retrieve the password")
+		}
+		return nil, errResponse.ErrorCode, responseError(httpResponse, errResponse.ErrorCode, errResponse.ErrorMessage)
+	}
+
+	// This endpoint returns the password as a JSON string. Without escapes,
+	// the quotes are simply stripped, so no copy of the password is made.
+	if len(body) >= 2 && body[0] == '"' && body[len(body)-1] == '"' && !bytes.ContainsRune(body, '\\') {
+		return newSecret(body[1 : len(body)-1]), "", nil
+	}
+	var passwd string
+	if err := json.Unmarshal(body, &passwd); err != nil {
+		return newSecret(body), "", nil
+	}
+	wipe(body)
+	return newSecret([]byte(passwd)), "", nil
+}
+
+// ServerInfo fetches the version and build information of the PVWA.
+func (api *caAPI) ServerInfo() (caServerInfo, error) {
+	url := api.endpoint("/API/Server")
+
+	httpReq, err := api.newRequest("GET", url, nil)
+	if err != nil {
+		return caServerInfo{}, err
+	}
+
+	httpResponse, body, err := api.do("server-info", httpReq)
+	if err != nil {
+		return caServerInfo{}, err
+	}
+
+	info := caServerInfo{}
+	err = json.Unmarshal(body, &info)
+	if err != nil {
+		return caServerInfo{}, err
+	}
+	if info.ErrorCode != "" {
+		return caServerInfo{}, responseError(httpResponse, info.ErrorCode, info.ErrorMessage)
+	}
+
+	return info, nil
+}
+
+// Platforms fetches the platforms defined in the vault.
+func (api *caAPI) Platforms() ([]caPlatform, error) {
+	url := api.endpoint("/API/Platforms")
+
+	httpReq, err := api.newRequest("GET", url, nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return string(bytes), nil
+	httpResponse, body, err := api.do("platforms", httpReq)
+	if err != nil {
+		return nil, err
+	}
+
+	response := caPlatformsResponse{}
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, err
+	}
+	if response.ErrorCode != "" {
+		return nil, responseError(httpResponse, response.ErrorCode, response.ErrorMessage)
+	}
+
+	platforms := make([]caPlatform, len(response.Platforms))
+	for i, p := range response.Platforms {
+		platforms[i] = p.General
+	}
+	return platforms, nil
+}
+
+// PSMConnect requests a connection to the account with the given ID through
+// the PSM, instead of retrieving its password. The parameters are sent as
+// is, such as "ConnectionComponent" and "reason". The returned connection
+// file, such as an RDP file, is to be opened by the matching client.
+func (api *caAPI) PSMConnect(accountID string, connectionParams map[string]string) ([]byte, error) {
+	url := api.endpoint("/API/Accounts/" + accountID + "/PSMConnect")
+
+	if connectionParams == nil {
+		connectionParams = map[string]string{}
+	}
+	b, err := json.Marshal(connectionParams)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal connect request: %s", err)
+	}
+
+	httpReq, err := api.newRequest("POST", url, bytes.NewBuffer(b))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResponse, body, err := api.do("psm-connect", httpReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode >= 300 {
+		errResponse := caErrorResponse{}
+		if err := json.Unmarshal(body, &errResponse); err != nil || errResponse.ErrorCode == "" {
+			return nil, statusError(httpResponse, "unable to connect to account %s", accountID)
+		}
+		return nil, responseError(httpResponse, errResponse.ErrorCode, errResponse.ErrorMessage)
+	}
+
+	// Depending on the version, the file is returned as is, or as a JSON
+	// string holding either the base64 encoded file or the file itself.
+	var encoded string
+	if len(body) == 0 || body[0] != '"' || json.Unmarshal(body, &encoded) != nil {
+		return body, nil
+	}
+	if file, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+		return file, nil
+	}
+	return []byte(encoded), nil
 }
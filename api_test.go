@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -39,3 +45,847 @@ func TestTimeUnMarshalling(t *testing.T) {
 		t.Error("incorrect last used date")
 	}
 }
+
+// Tests whether timestamps are parsed as seconds, milliseconds or ISO8601.
+func TestTimeFormats(t *testing.T) {
+	tests := []struct {
+		input string
+		want  time.Time
+	}{
+		{`1543600800`, time.Unix(1543600800, 0)},
+		{`"1543600800"`, time.Unix(1543600800, 0)},
+		{`1543600800123`, time.Unix(1543600800, 123000000)},
+		{`"1543600800123"`, time.Unix(1543600800, 123000000)},
+		{`"2018-11-30T18:00:00Z"`, time.Date(2018, 11, 30, 18, 0, 0, 0, time.UTC)},
+		{`"2018-11-30T19:00:00.5+01:00"`, time.Date(2018, 11, 30, 18, 0, 0, 500000000, time.UTC)},
+		{`"2018-11-30T18:00:00"`, time.Date(2018, 11, 30, 18, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		var got caTime
+		if err := json.Unmarshal([]byte(test.input), &got); err != nil {
+			t.Errorf("%s: unexpected error: %s", test.input, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("%s: expected %s, got %s", test.input, test.want, got.Time)
+		}
+	}
+
+	var got caTime
+	if err := json.Unmarshal([]byte(`"yesterday"`), &got); err == nil {
+		t.Errorf("expected an error for an unknown format, got %s", got.Time)
+	}
+}
+
+// Tests whether the caAPI can be used from multiple goroutines at once. Run
+// with -race to detect data races.
+func TestConcurrentUse(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/PasswordVault/WebServices/auth/Cyberark/CyberArkAuthenticationService.svc/Logon", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"CyberArkLogonResult": "another-logon-key"}`)
+	})
+	mux.HandleFunc("/PasswordVault/API/IncomingRequests", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"IncomingRequests": [{"RequestID": "1"}]}`)
+	})
+	mux.HandleFunc("/PasswordVault/API/MyRequests", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"MyRequests": [{"Status": 2}]}`)
+	})
+	api := newTestAPI(t, mux)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			if _, err := api.IncomingRequests(); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := api.MyRequests(); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := api.Login("user", newSecret([]byte("pass"))); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if key := api.logonKey(); key != "another-logon-key" {
+		t.Errorf("unexpected logon key '%s'", key)
+	}
+}
+
+// Tests whether the confirmation reason is validated and sent according to
+// the safe policy.
+func TestConfirmRequestReason(t *testing.T) {
+	var payload map[string]interface{}
+	var calls int
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		payload = nil
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+	}))
+
+	tests := []struct {
+		name      string
+		required  bool
+		reason    string
+		expectErr bool
+		expectMsg interface{}
+	}{
+		{"mandatory, empty", true, "", true, nil},
+		{"mandatory, present", true, "approved", false, "approved"},
+		{"optional, empty", false, "", false, nil},
+		{"optional, present", false, "approved", false, "approved"},
+	}
+
+	for _, test := range tests {
+		calls = 0
+		req := caIncomingRequest{RequestID: "1", ConfirmReasonRequired: test.required}
+		err := api.ConfirmRequest(req, test.reason)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			if calls != 0 {
+				t.Errorf("%s: expected no request to be sent", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+		if reason, ok := payload["Reason"]; reason != test.expectMsg || ok != (test.expectMsg != nil) {
+			t.Errorf("%s: unexpected reason in payload: %v", test.name, payload)
+		}
+	}
+}
+
+// Tests whether ApproveMatching confirms or skips requests depending on the
+// outcome of the decide callback.
+func TestApproveMatching(t *testing.T) {
+	var confirmed []string
+	var reasons []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/PasswordVault/API/IncomingRequests", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"IncomingRequests": [{"RequestID": "1"}, {"RequestID": "2"}, {"RequestID": "3"}, {"RequestID": "4"}]}`)
+	})
+	mux.HandleFunc("/PasswordVault/API/IncomingRequests/", func(w http.ResponseWriter, r *http.Request) {
+		payload := caConfirmRequest{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		if r.URL.Path == "/PasswordVault/API/IncomingRequests/3/Confirm" {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"ErrorCode": "PASWS002E", "ErrorMessage": "Broken"}`)
+			return
+		}
+		confirmed = append(confirmed, r.URL.Path)
+		reasons = append(reasons, payload.Reason)
+	})
+	api := newTestAPI(t, mux)
+
+	decide := func(r caIncomingRequest) (bool, string, error) {
+		switch r.RequestID {
+		case "1":
+			return true, "first", nil
+		case "2":
+			return false, "", nil
+		case "3":
+			return true, "third", nil
+		}
+		return false, "", fmt.Errorf("no idea")
+	}
+
+	results, err := api.ApproveMatching(context.Background(), decide)
+	if err == nil {
+		t.Error("expected the error returned by decide")
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results before the decide error, got %d", len(results))
+	}
+
+	if !results[0].Approved || results[0].Err != nil || results[0].Reason != "first" {
+		t.Errorf("expected request 1 to be confirmed, got %+v", results[0])
+	}
+	if results[1].Approved {
+		t.Errorf("expected request 2 to be skipped, got %+v", results[1])
+	}
+	if !results[2].Approved || results[2].Err == nil {
+		t.Errorf("expected request 3 to fail confirming, got %+v", results[2])
+	}
+
+	if len(confirmed) != 1 || confirmed[0] != "/PasswordVault/API/IncomingRequests/1/Confirm" || reasons[0] != "first" {
+		t.Errorf("unexpected confirmations: %v (%v)", confirmed, reasons)
+	}
+}
+
+// atomicVault serves requests of two requestors and records the calls made.
+// Confirming or rejecting the request IDs in failing fails.
+func atomicVault(calls *[]string, failing ...string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/PasswordVault/API/IncomingRequests/", func(w http.ResponseWriter, r *http.Request) {
+		*calls = append(*calls, strings.TrimPrefix(r.URL.Path, "/PasswordVault/API/IncomingRequests/"))
+		for _, f := range failing {
+			if strings.HasPrefix(r.URL.Path, "/PasswordVault/API/IncomingRequests/"+f) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"ErrorCode": "PASWS001E", "ErrorMessage": "Nope"}`)
+				return
+			}
+		}
+	})
+	return mux
+}
+
+// atomicRequests are requests of two requestors, interleaved.
+var atomicRequests = []caIncomingRequest{
+	{RequestID: "1", RequestorUserName: "ab12cd"},
+	{RequestID: "2", RequestorUserName: "EF34GH"},
+	{RequestID: "3", RequestorUserName: "AB12CD"},
+	{RequestID: "4", RequestorUserName: "ab12cd"},
+}
+
+func approveAll(r caIncomingRequest) (bool, string, error) {
+	return true, "ok", nil
+}
+
+// Tests whether all requests are confirmed per requestor when nothing fails.
+func TestApproveRequestsPerUser(t *testing.T) {
+	var calls []string
+	api := newTestAPI(t, atomicVault(&calls))
+
+	results, err := api.ApproveRequestsPerUser(context.Background(), atomicRequests, approveAll, strings.ToUpper, "undo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, res := range results {
+		if res.Request.RequestID != atomicRequests[i].RequestID {
+			t.Errorf("expected the results in the order of the requests, got %s at %d", res.Request.RequestID, i)
+		}
+		if res.Err != nil || res.Aborted || res.RolledBack {
+			t.Errorf("expected request %s to be confirmed, got %+v", res.Request.RequestID, res)
+		}
+	}
+	if want := "1/Confirm 3/Confirm 4/Confirm 2/Confirm"; strings.Join(calls, " ") != want {
+		t.Errorf("expected calls %q, got %q", want, strings.Join(calls, " "))
+	}
+}
+
+// Tests whether a failing confirmation rolls back the other requests of the
+// same requestor only.
+func TestApproveRequestsPerUserRollback(t *testing.T) {
+	var calls []string
+	api := newTestAPI(t, atomicVault(&calls, "3/Confirm"))
+
+	results, err := api.ApproveRequestsPerUser(context.Background(), atomicRequests, approveAll, strings.ToUpper, "undo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !results[0].RolledBack || results[0].RollbackErr != nil {
+		t.Errorf("expected request 1 to be rolled back, got %+v", results[0])
+	}
+	if results[1].Err != nil || results[1].RolledBack {
+		t.Errorf("expected request 2 of another requestor to stay confirmed, got %+v", results[1])
+	}
+	if results[2].Err == nil {
+		t.Errorf("expected request 3 to fail, got %+v", results[2])
+	}
+	if !results[3].Aborted {
+		t.Errorf("expected request 4 to be aborted, got %+v", results[3])
+	}
+	if want := "1/Confirm 3/Confirm 1/Reject 2/Confirm"; strings.Join(calls, " ") != want {
+		t.Errorf("expected calls %q, got %q", want, strings.Join(calls, " "))
+	}
+}
+
+// Tests whether requestors differing in case only are separate requestors when
+// grouping case-sensitively.
+func TestApproveRequestsPerUserCaseSensitive(t *testing.T) {
+	var calls []string
+	api := newTestAPI(t, atomicVault(&calls, "3/Confirm"))
+
+	results, err := api.ApproveRequestsPerUser(context.Background(), atomicRequests, approveAll, userFold(true), "undo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range []int{0, 3} {
+		if results[i].Err != nil || results[i].RolledBack || results[i].Aborted {
+			t.Errorf("expected request %s of ab12cd to stay confirmed, got %+v", results[i].Request.RequestID, results[i])
+		}
+	}
+	if results[2].Err == nil {
+		t.Errorf("expected request 3 of AB12CD to fail, got %+v", results[2])
+	}
+	if want := "1/Confirm 4/Confirm 2/Confirm 3/Confirm"; strings.Join(calls, " ") != want {
+		t.Errorf("expected calls %q, got %q", want, strings.Join(calls, " "))
+	}
+}
+
+// Tests whether a failing rollback is reported, leaving the request confirmed.
+func TestApproveRequestsPerUserRollbackFailure(t *testing.T) {
+	var calls []string
+	api := newTestAPI(t, atomicVault(&calls, "3/Confirm", "1/Reject"))
+
+	results, err := api.ApproveRequestsPerUser(context.Background(), atomicRequests, approveAll, strings.ToUpper, "undo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].RolledBack || results[0].RollbackErr == nil || results[0].Err != nil {
+		t.Errorf("expected request 1 to stay confirmed with a rollback error, got %+v", results[0])
+	}
+}
+
+// Tests whether ApproveMatching stops when the context is done.
+func TestApproveMatchingCancelled(t *testing.T) {
+	api := newTestAPI(t, incomingRequestsHandler(mixedRequests))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	called := false
+	_, err := api.ApproveMatching(ctx, func(r caIncomingRequest) (bool, string, error) {
+		called = true
+		return true, "", nil
+	})
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if called {
+		t.Error("expected decide not to be called")
+	}
+}
+
+// Tests whether logging out of an expired session is considered successful.
+func TestLogoutExpired(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusUnauthorized, http.StatusNotFound} {
+		api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		if err := api.Logout(); err != nil {
+			t.Errorf("status %d: unexpected error: %s", status, err)
+		}
+	}
+
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	if err := api.Logout(); err == nil {
+		t.Error("expected an error for an internal server error")
+	}
+}
+
+// Tests whether network failures while logging out are returned.
+func TestLogoutNetworkError(t *testing.T) {
+	api := newTestAPI(t, http.NotFoundHandler())
+	api.Base = "http://127.0.0.1:1"
+	if err := api.Logout(); err == nil {
+		t.Error("expected an error when the vault is unreachable")
+	}
+}
+
+// Tests whether the correlation ID of a response ends up in the error.
+func TestCorrelationID(t *testing.T) {
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Cybr-Correlation-Id", "d6e4c2a1-1234")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"ErrorCode": "PASWS001E", "ErrorMessage": "Nope"}`)
+	}))
+
+	err := api.ConfirmRequest(caIncomingRequest{RequestID: "1"}, "reason")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "d6e4c2a1-1234") {
+		t.Errorf("expected the correlation ID in the error, got '%s'", err)
+	}
+	if id := api.CorrelationID(); id != "d6e4c2a1-1234" {
+		t.Errorf("expected the last correlation ID to be remembered, got '%s'", id)
+	}
+}
+
+// Tests whether the correlation ID ends up in the error when the response
+// only has a status, without an error code.
+func TestCorrelationIDStatusOnly(t *testing.T) {
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Cybr-Correlation-Id", "d6e4c2a1-1234")
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+
+	calls := map[string]func() error{
+		"delete": func() error { return api.DeleteMyRequest("1") },
+		"deny":   func() error { return api.DenyRequest(caIncomingRequest{RequestID: "1"}, "no") },
+		"get password": func() error {
+			_, err := api.GetPassword(caMyRequest{}, "")
+			return err
+		},
+		"retrieve password": func() error {
+			_, _, err := api.RetrievePassword("12_3", "")
+			return err
+		},
+		"connect": func() error {
+			_, err := api.PSMConnect("12_3", nil)
+			return err
+		},
+	}
+	for name, call := range calls {
+		err := call()
+		if err == nil || !strings.Contains(err.Error(), "500") || !strings.Contains(err.Error(), "d6e4c2a1-1234") {
+			t.Errorf("%s: expected the status and correlation ID in the error, got %v", name, err)
+		}
+	}
+}
+
+// Tests which headers are considered to contain a correlation ID.
+func TestCorrelationIDHeaders(t *testing.T) {
+	tests := []struct {
+		headers  map[string]string
+		expected string
+	}{
+		{map[string]string{}, ""},
+		{map[string]string{"X-Request-Id": "abc"}, "abc"},
+		{map[string]string{"X-Request-Id": "abc", "X-Cybr-Correlation-Id": "def"}, "def"},
+		{map[string]string{"X-Cybr-Trace": "ghi", "Content-Type": "application/json"}, "ghi"},
+	}
+
+	for _, test := range tests {
+		h := http.Header{}
+		for k, v := range test.headers {
+			h.Set(k, v)
+		}
+		if got := correlationID(h); got != test.expected {
+			t.Errorf("%v: expected '%s', got '%s'", test.headers, test.expected, got)
+		}
+	}
+}
+
+// Tests whether the grant override ends up in the confirm payload.
+func TestConfirmRequestGrantUntil(t *testing.T) {
+	var payload map[string]interface{}
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload = nil
+		json.NewDecoder(r.Body).Decode(&payload)
+	}))
+
+	if err := api.ConfirmRequest(caIncomingRequest{RequestID: "1"}, "ok"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := payload["AccessTo"]; ok {
+		t.Errorf("expected no AccessTo without a grant override, got %v", payload)
+	}
+
+	api.GrantUntil = time.Unix(1543600800, 0)
+	if err := api.ConfirmRequest(caIncomingRequest{RequestID: "1"}, "ok"); err != nil {
+		t.Fatal(err)
+	}
+	if payload["AccessTo"] != float64(1543600800) {
+		t.Errorf("expected AccessTo 1543600800, got %v", payload["AccessTo"])
+	}
+	// A duration counts from every confirmation, not from the start.
+	api.GrantDuration = time.Hour
+	for i := 0; i < 2; i++ {
+		before := time.Now()
+		if err := api.ConfirmRequest(caIncomingRequest{RequestID: "1"}, "ok"); err != nil {
+			t.Fatal(err)
+		}
+		accessTo, _ := payload["AccessTo"].(float64)
+		if got := time.Unix(int64(accessTo), 0); got.Before(before.Add(time.Hour).Truncate(time.Second)) || got.After(time.Now().Add(time.Hour)) {
+			t.Errorf("expected AccessTo an hour from now, got %v", got)
+		}
+	}
+}
+
+// Tests whether Login fails over to the next base URL when the vault at the
+// primary one can't be reached.
+func TestLoginFailover(t *testing.T) {
+	api := newTestAPI(t, vaultHandler())
+	secondary := api.Base
+	api.Base = "http://127.0.0.1:1"
+	api.Fallbacks = []string{"http://127.0.0.1:2", secondary}
+	api.LogonKey = ""
+
+	if err := api.Login("AB12CD", newSecret([]byte("secret"))); err != nil {
+		t.Fatal(err)
+	}
+	if api.Base != secondary {
+		t.Errorf("expected the healthy secondary '%s' to become the base, got '%s'", secondary, api.Base)
+	}
+	if api.logonKey() != "test-logon-key" {
+		t.Errorf("expected to be logged in, got logon key '%s'", api.logonKey())
+	}
+
+	// Subsequent calls go to the healthy secondary.
+	if _, err := api.IncomingRequests(); err != nil {
+		t.Errorf("unexpected error after failing over: %s", err)
+	}
+}
+
+// Tests whether Login fails over when the primary vault answers, but isn't
+// serving, as a passive vault behind a load balancer does.
+func TestLoginFailoverUnavailable(t *testing.T) {
+	for _, body := range []string{"<html><body>Service Unavailable</body></html>", `{"ErrorCode": "PASWS999E", "ErrorMessage": "Broken"}`} {
+		api := newTestAPI(t, vaultHandler())
+		secondary := api.Base
+		primary := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, body)
+		}))
+		api.Base = primary.Base
+		api.Fallbacks = []string{secondary}
+		api.LogonKey = ""
+
+		if err := api.Login("AB12CD", newSecret([]byte("secret"))); err != nil {
+			t.Fatalf("%s: %s", body, err)
+		}
+		if api.Base != secondary {
+			t.Errorf("%s: expected the secondary '%s' to become the base, got '%s'", body, secondary, api.Base)
+		}
+	}
+
+	// Without another vault, the error of the last one is returned.
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "<html></html>")
+	}))
+	if err := api.Login("AB12CD", newSecret([]byte("secret"))); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("expected the status in the error, got %v", err)
+	}
+}
+
+// Tests whether an authentication failure does not fail over.
+func TestLoginNoFailoverOnAuthFailure(t *testing.T) {
+	var secondaryCalls int
+	secondary := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secondaryCalls++
+		fmt.Fprint(w, `{"CyberArkLogonResult": "test-logon-key"}`)
+	}))
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ErrorCode": "ITATS004E", "ErrorMessage": "Authentication failure"}`)
+	}))
+	primary := api.Base
+	api.Fallbacks = []string{secondary.Base}
+
+	if err := api.Login("AB12CD", newSecret([]byte("wrong"))); err == nil || !strings.Contains(err.Error(), "ITATS004E") {
+		t.Errorf("expected the authentication failure, got %v", err)
+	}
+	if secondaryCalls != 0 {
+		t.Errorf("expected the secondary not to be tried, got %d calls", secondaryCalls)
+	}
+	if api.Base != primary {
+		t.Errorf("expected the base to remain '%s', got '%s'", primary, api.Base)
+	}
+}
+
+// Tests whether the last connection error is returned when no vault can be
+// reached at all.
+func TestLoginAllUnreachable(t *testing.T) {
+	api := &caAPI{Base: "http://127.0.0.1:1", Fallbacks: []string{"http://127.0.0.1:2"}}
+	err := api.Login("AB12CD", newSecret([]byte("secret")))
+	if err == nil || !strings.Contains(err.Error(), "127.0.0.1:2") {
+		t.Errorf("expected a connection error for the last base URL, got %v", err)
+	}
+}
+
+// Tests decoding a sample server info response.
+func TestServerInfo(t *testing.T) {
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/PasswordVault/API/Server" {
+			t.Errorf("unexpected path '%s'", r.URL.Path)
+		}
+		fmt.Fprint(w, `{
+			"ServerName": "Vault",
+			"ServerID": "d3b5b2a1-c449-4fd4-9f34-1a2bf3b6cb9e",
+			"ApplicationsContextInfo": [],
+			"ExternalVersion": "10.6.0",
+			"InternalVersion": "10.6.0.13",
+			"Authentications": ["cyberark", "ldap", "radius"]
+		}`)
+	}))
+
+	info, err := api.ServerInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ServerName != "Vault" || info.ServerID != "d3b5b2a1-c449-4fd4-9f34-1a2bf3b6cb9e" {
+		t.Errorf("unexpected server: %+v", info)
+	}
+	if info.ExternalVersion != "10.6.0" || info.InternalVersion != "10.6.0.13" {
+		t.Errorf("unexpected version: %+v", info)
+	}
+}
+
+// Tests whether retrieving a password is retried while it's being changed.
+func TestGetPasswordRotation(t *testing.T) {
+	defer func(backoff time.Duration) { rotationBackoff = backoff }(rotationBackoff)
+	rotationBackoff = time.Millisecond
+
+	var attempts int
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts <= 2 {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `{"ErrorCode": "%s", "ErrorMessage": "Password is being changed"}`, caErrPasswordChanging)
+			return
+		}
+		fmt.Fprint(w, "hunter2")
+	}))
+
+	passwd, err := api.GetPassword(caMyRequest{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(passwd.Bytes()) != "hunter2" {
+		t.Errorf("expected the password, got '%s'", passwd.Bytes())
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+// Tests whether retrying gives up eventually, and other errors aren't
+// retried at all.
+func TestGetPasswordErrors(t *testing.T) {
+	defer func(backoff time.Duration) { rotationBackoff = backoff }(rotationBackoff)
+	rotationBackoff = time.Millisecond
+
+	tests := []struct {
+		code             string
+		expectedAttempts int
+	}{
+		{caErrPasswordChanging, rotationRetries + 1},
+		{"PASWS013E", 1},
+	}
+
+	for _, test := range tests {
+		var attempts int
+		api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `{"ErrorCode": "%s", "ErrorMessage": "Nope"}`, test.code)
+		}))
+
+		_, err := api.GetPassword(caMyRequest{}, "")
+		if err == nil || !strings.Contains(err.Error(), test.code) {
+			t.Errorf("%s: expected an error with the code, got %v", test.code, err)
+		}
+		if attempts != test.expectedAttempts {
+			t.Errorf("%s: expected %d attempts, got %d", test.code, test.expectedAttempts, attempts)
+		}
+	}
+}
+
+// Tests deleting my own request.
+func TestDeleteMyRequest(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusNoContent} {
+		var method, path string
+		api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			method, path = r.Method, r.URL.Path
+			w.WriteHeader(status)
+		}))
+
+		if err := api.DeleteMyRequest("01451_ZKV-M-DTA-O_2224"); err != nil {
+			t.Errorf("status %d: unexpected error: %s", status, err)
+		}
+		if method != "DELETE" || path != "/PasswordVault/API/MyRequests/01451_ZKV-M-DTA-O_2224" {
+			t.Errorf("status %d: unexpected request %s %s", status, method, path)
+		}
+	}
+}
+
+// Tests whether error responses of deleting my own request are returned.
+func TestDeleteMyRequestError(t *testing.T) {
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"ErrorCode": "PASWS148E", "ErrorMessage": "Request was not found"}`)
+	}))
+	if err := api.DeleteMyRequest("1"); err == nil || !strings.Contains(err.Error(), "PASWS148E") {
+		t.Errorf("expected the error response, got %v", err)
+	}
+
+	api = newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	if err := api.DeleteMyRequest("1"); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("expected the status in the error, got %v", err)
+	}
+}
+
+// Tests whether retrieving the password is retried with the given reason for
+// accounts requiring one.
+func TestGetPasswordReasonRequired(t *testing.T) {
+	var payload caRetrieveRequest
+	mux := http.NewServeMux()
+	mux.HandleFunc("/PasswordVault/WebServices/PIMServices.svc/Accounts/12_3/Credentials", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"ErrorCode": "%s", "ErrorMessage": "Reason is required"}`, caErrReasonRequired)
+	})
+	mux.HandleFunc("/PasswordVault/API/Accounts/12_3/Password/Retrieve", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			t.Errorf("unexpected method %s", r.Method)
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		fmt.Fprint(w, `"hunter2"`)
+	})
+	api := newTestAPI(t, mux)
+
+	req := caMyRequest{}
+	req.AccountDetails.AccountID = "12_3"
+
+	passwd, err := api.GetPassword(req, "Fixing prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(passwd.Bytes()) != "hunter2" {
+		t.Errorf("expected the password, got '%s'", passwd.Bytes())
+	}
+	if payload.Reason != "Fixing prod" {
+		t.Errorf("expected the reason to be sent, got '%s'", payload.Reason)
+	}
+
+	_, err = api.GetPassword(req, "")
+	if err == nil || !strings.Contains(err.Error(), "-reason") {
+		t.Errorf("expected an error asking for a reason, got %v", err)
+	}
+}
+
+// Tests whether the nested platforms response is decoded.
+func TestPlatforms(t *testing.T) {
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/PasswordVault/API/Platforms" {
+			t.Errorf("unexpected path '%s'", r.URL.Path)
+		}
+		fmt.Fprint(w, `{
+			"Platforms": [
+				{
+					"general": {"id": "WinDomain", "name": "Windows Domain Account", "systemType": "Windows", "active": true, "platformType": "Regular"},
+					"properties": {"required": [{"name": "Address"}]},
+					"credentialsManagement": {"allowManualChange": true}
+				},
+				{
+					"general": {"id": "UnixSSH", "name": "Unix via SSH", "systemType": "*NIX", "active": false}
+				}
+			],
+			"Total": 2
+		}`)
+	}))
+
+	platforms, err := api.Platforms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []caPlatform{
+		{ID: "WinDomain", Name: "Windows Domain Account", SystemType: "Windows", Active: true},
+		{ID: "UnixSSH", Name: "Unix via SSH", SystemType: "*NIX", Active: false},
+	}
+	if len(platforms) != len(want) {
+		t.Fatalf("expected %d platforms, got %+v", len(want), platforms)
+	}
+	for i := range want {
+		if platforms[i] != want[i] {
+			t.Errorf("expected %+v, got %+v", want[i], platforms[i])
+		}
+	}
+}
+
+// Tests whether the connection file is decoded, whether it's returned as is,
+// base64 encoded in a JSON string, or in a plain JSON string.
+func TestPSMConnect(t *testing.T) {
+	const rdp = "full address:s:10.0.0.1\r\nusername:s:AB12CD\r\n"
+
+	for _, response := range []string{
+		rdp,
+		`"` + base64.StdEncoding.EncodeToString([]byte(rdp)) + `"`,
+		`"full address:s:10.0.0.1\r\nusername:s:AB12CD\r\n"`,
+	} {
+		var params map[string]string
+		api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" || r.URL.Path != "/PasswordVault/API/Accounts/12_3/PSMConnect" {
+				t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			}
+			json.NewDecoder(r.Body).Decode(&params)
+			fmt.Fprint(w, response)
+		}))
+
+		file, err := api.PSMConnect("12_3", map[string]string{"ConnectionComponent": "PSM-RDP", "reason": "Fixing prod"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(file) != rdp {
+			t.Errorf("%q: expected the RDP file, got %q", response, file)
+		}
+		if params["ConnectionComponent"] != "PSM-RDP" || params["reason"] != "Fixing prod" {
+			t.Errorf("unexpected connection parameters %v", params)
+		}
+	}
+}
+
+// Tests whether an error of the vault is returned when connecting.
+func TestPSMConnectError(t *testing.T) {
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"ErrorCode": "PASWS013E", "ErrorMessage": "No permission"}`)
+	}))
+
+	if _, err := api.PSMConnect("12_3", nil); err == nil || !strings.Contains(err.Error(), "PASWS013E") {
+		t.Errorf("expected the error of the vault, got %v", err)
+	}
+}
+
+// Tests whether every endpoint honors a custom API prefix, including the
+// root.
+func TestAPIPrefix(t *testing.T) {
+	for prefix, want := range map[string]string{"/pvwa": "/pvwa/", "/cyberark/pvwa/": "/cyberark/pvwa/", "/": "/"} {
+		var paths []string
+		api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.URL.Path)
+			if strings.HasSuffix(r.URL.Path, "/Logon") {
+				fmt.Fprint(w, `{"CyberArkLogonResult": "key"}`)
+				return
+			}
+			fmt.Fprint(w, `{}`)
+		}))
+		api.APIPrefix = prefix
+
+		api.Login("AB12CD", newSecret([]byte("secret")))
+		api.IncomingRequests()
+		api.ConfirmRequest(caIncomingRequest{RequestID: "1"}, "")
+		api.DenyRequest(caIncomingRequest{RequestID: "1"}, "")
+		api.MyRequests()
+		api.CreateRequest("12_3", "")
+		api.DeleteMyRequest("2")
+		req := caMyRequest{}
+		req.AccountDetails.AccountID = "12_3"
+		api.GetPassword(req, "")
+		api.RetrievePassword("12_3", "because")
+		api.ServerInfo()
+		api.Platforms()
+		api.PSMConnect("12_3", nil)
+		api.Logout()
+
+		if len(paths) != 13 {
+			t.Errorf("%s: expected 13 requests, got %v", prefix, paths)
+		}
+		for _, path := range paths {
+			if !strings.HasPrefix(path, want) || strings.Contains(path, "PasswordVault") || strings.Contains(path, "//") {
+				t.Errorf("%s: expected path %s to start with %s", prefix, path, want)
+			}
+		}
+	}
+}
+
+// Tests whether the default prefix is used when none is set.
+func TestAPIPrefixDefault(t *testing.T) {
+	api := &caAPI{Base: "https://pwv.example.com"}
+	if url := api.endpoint("/API/Server"); url != "https://pwv.example.com/PasswordVault/API/Server" {
+		t.Errorf("expected the default prefix, got %s", url)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// commonFlags are the flags accepted by every subcommand.
+var commonFlags = []string{
+	"url", "api-prefix", "username", "password", "pinentry", "netrc", "safe-regex",
+	"log-format", "quiet", "no-logout", "stats", "record", "replay",
+	"max-idle-conns", "idle-conn-timeout", "dial-timeout", "tls-timeout", "force-http1", "disable-keepalives", "header",
+}
+
+// subcommands maps every subcommand to the flags relevant to it, on top of
+// the common flags. The name of a subcommand equals its -operation.
+var subcommands = map[string][]string{
+	"list": {"since", "until", "format", "show-requestor", "limit", "mask-names", "template"},
+	"approve": {
+		"allowedusers", "case-sensitive-users", "target-username", "require-prior-use", "reason", "interactive",
+		"grant-duration", "grant-until", "max-grant", "max-pending", "atomic-per-user", "fail-fast",
+		"watch", "confirm-cooldown", "webhook", "format",
+	},
+	"retrieve":         {"reason", "mask-names"},
+	"request-and-wait": {"accountid", "reason", "wait-interval", "wait-timeout"},
+	"cancel":           {"requestid"},
+	"diagnose":         {},
+	"serverinfo":       {},
+	"platforms":        {"format"},
+	"dump":             {"output", "dump-myrequests"},
+	"connect":          {"accountid", "connection-component", "reason", "output"},
+}
+
+// activeFlags is the flag set the command line was parsed with.
+var activeFlags = flag.CommandLine
+
+// globalFlags are the common flags given before the subcommand, such as -url
+// in "pwv -url https://vault approve".
+var globalFlags map[string]bool
+
+// parseArgs parses the command line arguments, without the program name.
+// When the first argument is a subcommand, such as "pwv list -since 24h", only
+// the flags of that subcommand are accepted. Otherwise the legacy form with
+// -operation and all flags is parsed, unless it's followed by a subcommand,
+// in which case only the common flags may precede it. Errors are reported on
+// stderr already.
+func parseArgs(args []string) error {
+	globalFlags = nil
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return parseSubcommand(args[0], args[1:])
+	}
+
+	activeFlags = flag.CommandLine
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+	if flag.NArg() == 0 {
+		if flagGiven("operation") {
+			fmt.Fprintf(stderr, "WARNING: -operation is deprecated and will be removed, use 'pwv %s' instead.\n", *flagOperation)
+		}
+		return nil
+	}
+
+	name := flag.Arg(0)
+	if _, ok := subcommands[name]; !ok || flagGiven("operation") {
+		fmt.Fprintf(stderr, "Unexpected argument '%s'\n", name)
+		return fmt.Errorf("unexpected argument '%s'", name)
+	}
+	given := make(map[string]bool)
+	var err error
+	flag.CommandLine.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+		if err == nil && !isCommonFlag(f.Name) {
+			fmt.Fprintf(stderr, "Flag -%s must be given after the subcommand '%s'\n", f.Name, name)
+			err = fmt.Errorf("flag -%s must be given after the subcommand", f.Name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err := parseSubcommand(name, flag.Args()[1:]); err != nil {
+		return err
+	}
+	globalFlags = given
+	return nil
+}
+
+// parseSubcommand parses the flags of the subcommand with the given name.
+func parseSubcommand(name string, args []string) error {
+	names, ok := subcommands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "Unknown subcommand '%s', expected one of: %s\n", name, strings.Join(subcommandNames(), ", "))
+		return fmt.Errorf("unknown subcommand '%s'", name)
+	}
+
+	// The flags share their values with the global ones, so the rest of the
+	// program doesn't need to know how they were given.
+	fs := flag.NewFlagSet("pwv "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	for _, n := range append(append([]string{}, commonFlags...), names...) {
+		f := flag.CommandLine.Lookup(n)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pwv %s [flags]\n", name)
+		fs.PrintDefaults()
+	}
+
+	activeFlags = fs
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(stderr, "Unexpected argument '%s'\n", fs.Arg(0))
+		fs.Usage()
+		return fmt.Errorf("unexpected argument '%s'", fs.Arg(0))
+	}
+	*flagOperation = name
+	return nil
+}
+
+// isCommonFlag returns whether the flag is accepted by every subcommand.
+func isCommonFlag(name string) bool {
+	for _, n := range commonFlags {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// subcommandNames returns the names of all subcommands, sorted.
+func subcommandNames() []string {
+	var names []string
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: pwv SUBCOMMAND [flags]\n\n")
+	fmt.Fprintf(os.Stderr, "Subcommands: %s\n", strings.Join(subcommandNames(), ", "))
+	fmt.Fprintf(os.Stderr, "Run 'pwv SUBCOMMAND -h' for the flags of a subcommand. All flags:\n\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "Examples:\n\n")
+	fmt.Fprintf(os.Stderr, "pwv approve -username CORPKEY -allowedusers KEY1,Key2,KEY3\n")
+	fmt.Fprintf(os.Stderr, "pwv approve -username CORPKEY -allowedusers KEY1,KEY2 -watch 1m\n")
+	fmt.Fprintf(os.Stderr, "pwv list -username CORPKEY\n")
+	fmt.Fprintf(os.Stderr, "pwv request-and-wait -username CORPKEY -accountid 12_3 -reason 'Fixing prod'\n")
+	fmt.Fprintf(os.Stderr, "pwv cancel -username CORPKEY -requestid 01451_ZKV-M-DTA-O_2224\n")
+	fmt.Fprintf(os.Stderr, "pwv diagnose -username CORPKEY\n")
+	fmt.Fprintf(os.Stderr, "pwv dump -username CORPKEY -dump-myrequests -output requests.json\n")
+	fmt.Fprintf(os.Stderr, "pwv list -username CORPKEY -record session\n")
+	fmt.Fprintf(os.Stderr, "pwv list -username CORPKEY -replay session\n")
+	fmt.Fprintf(os.Stderr, "pwv connect -username CORPKEY -accountid 12_3 -reason 'Fixing prod' -output prod.rdp\n")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetFlags restores the defaults of all flags after the test. The command
+// line flag set is replaced as well, since it remembers which flags were set.
+func resetFlags(t *testing.T) {
+	t.Cleanup(func() {
+		fresh := flag.NewFlagSet(flag.CommandLine.Name(), flag.ContinueOnError)
+		flag.VisitAll(func(f *flag.Flag) {
+			if !strings.HasPrefix(f.Name, "test.") {
+				f.Value.Set(f.DefValue)
+			}
+			fresh.Var(f.Value, f.Name, f.Usage)
+		})
+		// The header flag can't be set to its empty default.
+		flagHeaders.header = nil
+		flag.CommandLine = fresh
+		activeFlags = flag.CommandLine
+		globalFlags = nil
+	})
+}
+
+// Tests dispatching every subcommand, including one of its own flags.
+func TestParseArgsSubcommands(t *testing.T) {
+	tests := []struct {
+		args  []string
+		check func() bool
+	}{
+		{[]string{"list", "-since", "24h", "-format", "csv"}, func() bool { return *flagSince == "24h" && *flagFormat == "csv" }},
+		{[]string{"approve", "-allowedusers", "AB12CD", "-watch", "1m"}, func() bool { return *flagAllowedCorpKeys == "AB12CD" && *flagWatch == time.Minute }},
+		{[]string{"retrieve", "-reason", "incident"}, func() bool { return *flagConfirmReason == "incident" && flagGiven("reason") }},
+		{[]string{"request-and-wait", "-accountid", "12_3"}, func() bool { return *flagAccountID == "12_3" }},
+		{[]string{"cancel", "-requestid", "01451_2224"}, func() bool { return *flagRequestID == "01451_2224" }},
+		{[]string{"diagnose", "-username", "AB12CD"}, func() bool { return *flagUsername == "AB12CD" }},
+		{[]string{"serverinfo", "-quiet"}, func() bool { return *flagQuiet }},
+		{[]string{"platforms", "-format", "csv"}, func() bool { return *flagFormat == "csv" }},
+		{[]string{"dump", "-output", "out.json", "-dump-myrequests"}, func() bool { return *flagOutput == "out.json" && *flagDumpMine }},
+		{[]string{"connect", "-accountid", "12_3", "-output", "prod.rdp"}, func() bool { return *flagAccountID == "12_3" && *flagOutput == "prod.rdp" }},
+	}
+
+	for _, test := range tests {
+		resetFlags(t)
+		captureOutput(t)
+		if err := parseArgs(test.args); err != nil {
+			t.Errorf("%v: unexpected error: %s", test.args, err)
+			continue
+		}
+		if *flagOperation != test.args[0] {
+			t.Errorf("%v: expected operation %s, got %s", test.args, test.args[0], *flagOperation)
+		}
+		if !test.check() {
+			t.Errorf("%v: flags were not set", test.args)
+		}
+	}
+	if len(tests) != len(subcommands) {
+		t.Errorf("expected a test for each of the %d subcommands", len(subcommands))
+	}
+}
+
+// Tests whether subcommands reject unknown subcommands, flags of other
+// subcommands and stray arguments.
+func TestParseArgsErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{"approv"},
+		{"cancel", "-allowedusers", "AB12CD"},
+		{"list", "extra"},
+	} {
+		resetFlags(t)
+		captureOutput(t)
+		if err := parseArgs(args); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+// Tests whether the legacy -operation flag keeps working, with a warning, and
+// whether a subcommand may follow the common flags.
+func TestParseArgsLegacy(t *testing.T) {
+	resetFlags(t)
+
+	_, errOut := captureOutput(t)
+	if err := parseArgs([]string{"-username", "AB12CD"}); err != nil {
+		t.Fatal(err)
+	}
+	if *flagOperation != "list" || *flagUsername != "AB12CD" {
+		t.Errorf("expected the default operation, got %s for %s", *flagOperation, *flagUsername)
+	}
+	if errOut.Len() != 0 {
+		t.Errorf("expected no warning without -operation, got %q", errOut.String())
+	}
+
+	captureOutput(t)
+	if err := parseArgs([]string{"-username", "AB12CD", "approve", "-allowedusers", "EF34GH"}); err != nil {
+		t.Fatal(err)
+	}
+	if *flagOperation != "approve" || *flagUsername != "AB12CD" || *flagAllowedCorpKeys != "EF34GH" {
+		t.Errorf("expected approve for AB12CD, got %s for %s (%s)", *flagOperation, *flagUsername, *flagAllowedCorpKeys)
+	}
+	if !flagGiven("username") || !flagGiven("allowedusers") {
+		t.Errorf("expected the flags before and after the subcommand to be given")
+	}
+
+	// Arguments which can't be run as a subcommand aren't silently dropped.
+	for _, args := range [][]string{
+		{"-username", "AB12CD", "approv"},
+		{"-allowedusers", "AB12CD", "cancel"},
+		{"-username", "AB12CD", "approve", "extra"},
+		{"-username", "AB12CD", "-operation", "list", "approve"},
+	} {
+		captureOutput(t)
+		if err := parseArgs(args); err == nil {
+			t.Errorf("%v: expected an error instead of running %s", args, *flagOperation)
+		}
+	}
+
+	_, errOut = captureOutput(t)
+	if err := parseArgs([]string{"-operation", "cancel", "-requestid", "01451_2224", "-allowedusers", "AB12CD"}); err != nil {
+		t.Fatal(err)
+	}
+	if *flagOperation != "cancel" || *flagRequestID != "01451_2224" || *flagAllowedCorpKeys != "AB12CD" {
+		t.Errorf("expected all flags to be accepted, got %s %s %s", *flagOperation, *flagRequestID, *flagAllowedCorpKeys)
+	}
+	if !strings.Contains(errOut.String(), "use 'pwv cancel' instead") {
+		t.Errorf("expected a deprecation warning, got %q", errOut.String())
+	}
+}
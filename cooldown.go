@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+)
+
+// maxCooldownDoublings limits how often the cooldown delay is doubled on
+// consecutive failures.
+const maxCooldownDoublings = 5
+
+// confirmCooldown keeps track of failed confirmations per request ID, so a
+// request which failed to confirm isn't retried right away on the next poll.
+// The delay doubles with every consecutive failure of the same request.
+type confirmCooldown struct {
+	delay    time.Duration
+	now      func() time.Time
+	failures map[string]cooldownState
+}
+
+// cooldownState is the state of a single request which failed to confirm.
+type cooldownState struct {
+	count int       // The number of consecutive failures.
+	until time.Time // The request is not retried before this time.
+}
+
+// newConfirmCooldown creates a cooldown which waits delay after the first
+// failure of a request.
+func newConfirmCooldown(delay time.Duration) *confirmCooldown {
+	return &confirmCooldown{
+		delay:    delay,
+		now:      time.Now,
+		failures: make(map[string]cooldownState),
+	}
+}
+
+// allowed returns whether confirming the request may be attempted now.
+func (c *confirmCooldown) allowed(requestID string) bool {
+	state, ok := c.failures[requestID]
+	return !ok || !c.now().Before(state.until)
+}
+
+// failed records a failed confirmation of the request, starting or extending
+// its cooldown.
+func (c *confirmCooldown) failed(requestID string) {
+	state := c.failures[requestID]
+	doublings := state.count
+	if doublings > maxCooldownDoublings {
+		doublings = maxCooldownDoublings
+	}
+	state.count++
+	state.until = c.now().Add(c.delay << uint(doublings))
+	c.failures[requestID] = state
+}
+
+// succeeded records a successful confirmation, forgetting any failures.
+func (c *confirmCooldown) succeeded(requestID string) {
+	delete(c.failures, requestID)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests whether the cooldown delay doubles on consecutive failures.
+func TestConfirmCooldown(t *testing.T) {
+	now := time.Unix(1543388400, 0)
+	c := newConfirmCooldown(time.Minute)
+	c.now = func() time.Time { return now }
+
+	if !c.allowed("1") {
+		t.Error("expected an unknown request to be allowed")
+	}
+
+	c.failed("1")
+	now = now.Add(59 * time.Second)
+	if c.allowed("1") {
+		t.Error("expected the request to be cooling down after the first failure")
+	}
+	now = now.Add(time.Second)
+	if !c.allowed("1") {
+		t.Error("expected the request to be allowed after the delay")
+	}
+
+	c.failed("1")
+	now = now.Add(time.Minute)
+	if c.allowed("1") {
+		t.Error("expected the delay to double after the second failure")
+	}
+	now = now.Add(time.Minute)
+	if !c.allowed("1") {
+		t.Error("expected the request to be allowed after the doubled delay")
+	}
+
+	c.failed("1")
+	c.succeeded("1")
+	if !c.allowed("1") {
+		t.Error("expected a succeeded request to be allowed right away")
+	}
+}
+
+// Tests whether a request which failed to confirm is skipped while cooling
+// down, and retried afterwards.
+func TestApproveCooldown(t *testing.T) {
+	var confirms int
+	handler := incomingRequestsHandler(`{"RequestID": "1", "RequestorUserName": "AB12CD"}`, "1")
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/Confirm") {
+			confirms++
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	out, _ := captureOutput(t)
+
+	now := time.Unix(1543388400, 0)
+	cooldown := newConfirmCooldown(time.Minute)
+	cooldown.now = func() time.Time { return now }
+
+	approveIncoming(api, "AB12CD", cooldown)
+	if confirms != 1 {
+		t.Fatalf("expected 1 confirmation attempt, got %d", confirms)
+	}
+
+	now = now.Add(30 * time.Second)
+	approveIncoming(api, "AB12CD", cooldown)
+	if confirms != 1 {
+		t.Errorf("expected no retry during the cooldown, got %d attempts", confirms)
+	}
+	if !strings.Contains(out.String(), "Cooling down: AB12CD") {
+		t.Errorf("expected the request to be reported as cooling down, got:\n%s", out)
+	}
+
+	now = now.Add(31 * time.Second)
+	approveIncoming(api, "AB12CD", cooldown)
+	if confirms != 2 {
+		t.Errorf("expected a retry after the cooldown, got %d attempts", confirms)
+	}
+}
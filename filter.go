@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// safeRegex restricts every operation to the safes matching it, acting as a
+// guardrail against touching safes outside of the operator's remit. It is
+// nil when not restricted.
+var safeRegex *regexp.Regexp
+
+// safeAllowed returns whether the safe may be touched, according to safeRegex.
+func safeAllowed(safe string) bool {
+	return safeRegex == nil || safeRegex.MatchString(safe)
+}
+
+// safeFilter accepts requests for safes which may be touched.
+func safeFilter(r caIncomingRequest) (bool, string) {
+	return reject(safeAllowed(r.AccountDetails.Properties.Safe), skipSafe)
+}
+
+// requestFilter decides whether an incoming request should be acted upon.
+// When not, the reason is returned as well, being one of the skip reasons.
+type requestFilter func(r caIncomingRequest) (bool, string)
+
+// The reasons for a filter not to accept a request, as shown to the user.
+const (
+	skipSafe     = "safe-not-allowed"
+	skipUser     = "user-not-allowed"
+	skipUsername = "username-not-allowed"
+	skipPriorUse = "no-prior-use"
+	skipWindow   = "outside-window"
+	skipGrant    = "grant-too-long"
+)
+
+// reject returns the result of a filter: accepted without a reason when ok,
+// or not accepted for the given reason.
+func reject(ok bool, reason string) (bool, string) {
+	if ok {
+		return true, ""
+	}
+	return false, reason
+}
+
+// allFilters composes the given filters into one filter, which only accepts
+// a request when every one of the filters accepts it. Otherwise the reason of
+// the first filter not accepting it is returned.
+func allFilters(filters ...requestFilter) requestFilter {
+	return func(r caIncomingRequest) (bool, string) {
+		for _, f := range filters {
+			if ok, reason := f(r); !ok {
+				return false, reason
+			}
+		}
+		return true, ""
+	}
+}
+
+// splitList splits a comma separated list into a set of upper cased,
+// trimmed values. Empty values are discarded.
+func splitList(list string) map[string]bool {
+	return splitListFunc(list, strings.ToUpper)
+}
+
+// splitListFunc splits a comma separated list into a set of trimmed values,
+// with fold applied to each of them. Empty values are discarded.
+func splitListFunc(list string, fold func(string) string) map[string]bool {
+	set := make(map[string]bool)
+	for _, v := range strings.Split(list, ",") {
+		v = strings.Trim(v, " ")
+		v = fold(v)
+		if v != "" {
+			set[v] = true
+		}
+	}
+	return set
+}
+
+// requestorFilter accepts requests made by one of the users in the comma
+// separated list. The usernames are compared case-insensitively, unless
+// caseSensitive is set.
+func requestorFilter(users string, caseSensitive bool) requestFilter {
+	fold := userFold(caseSensitive)
+	set := splitListFunc(users, fold)
+	return func(r caIncomingRequest) (bool, string) {
+		return reject(set[fold(r.RequestorUserName)], skipUser)
+	}
+}
+
+// userFold returns the function mapping user names which are the same to the
+// same string, which is the user name itself when case sensitive.
+func userFold(caseSensitive bool) func(string) string {
+	if caseSensitive {
+		return func(s string) string { return s }
+	}
+	return strings.ToUpper
+}
+
+// targetUsernameFilter accepts requests for accounts which have one of the
+// given (upper cased) usernames. An empty set accepts every request.
+func targetUsernameFilter(usernames map[string]bool) requestFilter {
+	return func(r caIncomingRequest) (bool, string) {
+		if len(usernames) == 0 {
+			return true, ""
+		}
+		return reject(usernames[strings.ToUpper(r.AccountDetails.Properties.Username)], skipUsername)
+	}
+}
+
+// priorUseFilter accepts requests for accounts which were last used by the
+// requestor, compared case-insensitively, when required. Accounts never used
+// before are not accepted either.
+func priorUseFilter(required bool) requestFilter {
+	return func(r caIncomingRequest) (bool, string) {
+		if !required {
+			return true, ""
+		}
+		lastUsedBy := strings.TrimSpace(r.AccountDetails.Properties.LastUsedBy)
+		return reject(lastUsedBy != "" && strings.EqualFold(lastUsedBy, strings.TrimSpace(r.RequestorUserName)), skipPriorUse)
+	}
+}
+
+// parseTime parses s as either an RFC3339 timestamp, or as a duration
+// relative to now. A relative duration such as "24h" denotes the time 24
+// hours before now. An empty string results in the zero time.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'%s' is neither an RFC3339 time nor a duration", s)
+	}
+	return now.Add(-d), nil
+}
+
+// accessWindowFilter accepts requests whose access window lies within since
+// and until, both inclusive. A zero since or until leaves that end of the
+// range open.
+func accessWindowFilter(since, until time.Time) requestFilter {
+	return func(r caIncomingRequest) (bool, string) {
+		if !since.IsZero() && r.AccessFrom.Before(since) {
+			return false, skipWindow
+		}
+		if !until.IsZero() && r.AccessTo.After(until) {
+			return false, skipWindow
+		}
+		return true, ""
+	}
+}
+
+// accessWindow returns the duration of the access window of the request.
+// The boolean result is false when the window is unknown, because either
+// end is missing or the window ends before it starts.
+func accessWindow(r caIncomingRequest) (time.Duration, bool) {
+	if r.AccessFrom.IsZero() || r.AccessTo.IsZero() || r.AccessTo.Before(r.AccessFrom.Time) {
+		return 0, false
+	}
+	return r.AccessTo.Sub(r.AccessFrom.Time), true
+}
+
+// maxGrantFilter accepts requests with an access window of at most max. To
+// be on the safe side, requests with an unknown window are not accepted. A
+// zero max accepts every request.
+func maxGrantFilter(max time.Duration) requestFilter {
+	return func(r caIncomingRequest) (bool, string) {
+		if max == 0 {
+			return true, ""
+		}
+		window, ok := accessWindow(r)
+		return reject(ok && window <= max, skipGrant)
+	}
+}
+
+// skipSummary summarizes how often every reason occurs, most frequent first,
+// such as "5 user-not-allowed, 3 outside-window".
+func skipSummary(reasons map[string]int) string {
+	names := make([]string, 0, len(reasons))
+	for reason := range reasons {
+		names = append(names, reason)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if reasons[names[i]] != reasons[names[j]] {
+			return reasons[names[i]] > reasons[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	parts := make([]string, len(names))
+	for i, reason := range names {
+		parts[i] = fmt.Sprintf("%d %s", reasons[reason], reason)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+// newRequest creates an incoming request for the given requestor and
+// account username.
+func newRequest(requestor, username string) caIncomingRequest {
+	r := caIncomingRequest{RequestorUserName: requestor}
+	r.AccountDetails.Properties.Username = username
+	return r
+}
+
+// Tests whether matching on the account username is case-insensitive.
+func TestTargetUsernameFilter(t *testing.T) {
+	filter := targetUsernameFilter(splitList(" root , svc_Deploy"))
+
+	tests := []struct {
+		username string
+		expected bool
+	}{
+		{"root", true},
+		{"ROOT", true},
+		{"SVC_deploy", true},
+		{"administrator", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if got, _ := filter(newRequest("AB12CD", test.username)); got != test.expected {
+			t.Errorf("username '%s': expected %v, got %v", test.username, test.expected, got)
+		}
+	}
+
+	if ok, _ := targetUsernameFilter(splitList(""))(newRequest("AB12CD", "whatever")); !ok {
+		t.Error("expected an empty username list to accept every request")
+	}
+}
+
+// Tests whether only accounts last used by the requestor are accepted when
+// prior use is required.
+func TestPriorUseFilter(t *testing.T) {
+	tests := []struct {
+		requestor  string
+		lastUsedBy string
+		expected   bool
+	}{
+		{"AB12CD", "AB12CD", true},
+		{"ab12cd", "AB12CD", true},
+		{"AB12CD", " ab12cd ", true},
+		{"AB12CD", "EF34GH", false},
+		{"AB12CD", "", false},
+		{"", "", false},
+	}
+
+	filter := priorUseFilter(true)
+	for _, test := range tests {
+		r := newRequest(test.requestor, "root")
+		r.AccountDetails.Properties.LastUsedBy = test.lastUsedBy
+		if got, _ := filter(r); got != test.expected {
+			t.Errorf("requestor '%s', last used by '%s': expected %v, got %v", test.requestor, test.lastUsedBy, test.expected, got)
+		}
+	}
+
+	if ok, _ := priorUseFilter(false)(newRequest("AB12CD", "root")); !ok {
+		t.Error("expected every request to be accepted when prior use isn't required")
+	}
+}
+
+// Tests whether the filters compose, requiring all of them to match.
+func TestAllFilters(t *testing.T) {
+	filter := allFilters(
+		requestorFilter("ab12cd", false),
+		targetUsernameFilter(splitList("root")),
+	)
+
+	tests := []struct {
+		requestor string
+		username  string
+		expected  bool
+	}{
+		{"AB12CD", "root", true},
+		{"ab12cd", "Root", true},
+		{"AB12CD", "oracle", false},
+		{"XX99XX", "root", false},
+		{"XX99XX", "oracle", false},
+	}
+
+	for _, test := range tests {
+		if got, _ := filter(newRequest(test.requestor, test.username)); got != test.expected {
+			t.Errorf("%s/%s: expected %v, got %v", test.requestor, test.username, test.expected, got)
+		}
+	}
+}
+
+// Tests matching the requestor, with and without case folding.
+func TestRequestorFilter(t *testing.T) {
+	tests := []struct {
+		requestor     string
+		caseSensitive bool
+		expected      bool
+	}{
+		{"AB12CD", false, true},
+		{"ab12cd", false, true},
+		{"Ef34gh", false, true},
+		{"XX99XX", false, false},
+		{"AB12CD", true, true},
+		{"ab12cd", true, false},
+		{"Ef34gh", true, true},
+		{"EF34GH", true, false},
+	}
+
+	for _, test := range tests {
+		filter := requestorFilter("AB12CD, Ef34gh", test.caseSensitive)
+		if got, _ := filter(newRequest(test.requestor, "")); got != test.expected {
+			t.Errorf("%s (case-sensitive: %v): expected %v, got %v", test.requestor, test.caseSensitive, test.expected, got)
+		}
+	}
+}
+
+// Tests parsing of absolute and relative times.
+func TestParseTime(t *testing.T) {
+	now := time.Date(2018, 11, 28, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		input    string
+		expected time.Time
+	}{
+		{"", time.Time{}},
+		{"2018-11-27T08:30:00Z", time.Date(2018, 11, 27, 8, 30, 0, 0, time.UTC)},
+		{"24h", now.Add(-24 * time.Hour)},
+		{"90m", now.Add(-90 * time.Minute)},
+	}
+
+	for _, test := range tests {
+		got, err := parseTime(test.input, now)
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %s", test.input, err)
+		}
+		if !got.Equal(test.expected) {
+			t.Errorf("'%s': expected %v, got %v", test.input, test.expected, got)
+		}
+	}
+
+	if _, err := parseTime("yesterday", now); err == nil {
+		t.Error("expected an error for an unparseable time")
+	}
+}
+
+// Tests the boundaries of the access window filter, including open ends.
+func TestAccessWindowFilter(t *testing.T) {
+	since := time.Unix(1543388400, 0)
+	until := time.Unix(1543600800, 0)
+
+	window := func(from, to int64) caIncomingRequest {
+		r := caIncomingRequest{}
+		r.AccessFrom.Time = time.Unix(from, 0)
+		r.AccessTo.Time = time.Unix(to, 0)
+		return r
+	}
+
+	tests := []struct {
+		name     string
+		filter   requestFilter
+		request  caIncomingRequest
+		expected bool
+	}{
+		{"exactly on boundaries", accessWindowFilter(since, until), window(1543388400, 1543600800), true},
+		{"within", accessWindowFilter(since, until), window(1543388401, 1543600799), true},
+		{"starts before since", accessWindowFilter(since, until), window(1543388399, 1543600800), false},
+		{"ends after until", accessWindowFilter(since, until), window(1543388400, 1543600801), false},
+		{"only since", accessWindowFilter(since, time.Time{}), window(1543388400, 1999999999), true},
+		{"only since, too early", accessWindowFilter(since, time.Time{}), window(1000000000, 1999999999), false},
+		{"only until", accessWindowFilter(time.Time{}, until), window(1000000000, 1543600800), true},
+		{"only until, too late", accessWindowFilter(time.Time{}, until), window(1000000000, 1543600801), false},
+		{"fully open", accessWindowFilter(time.Time{}, time.Time{}), window(0, 0), true},
+	}
+
+	for _, test := range tests {
+		if got, _ := test.filter(test.request); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+// Tests the maximum access window, including unknown windows.
+func TestMaxGrantFilter(t *testing.T) {
+	window := func(from, to int64) caIncomingRequest {
+		r := caIncomingRequest{}
+		if from != 0 {
+			r.AccessFrom.Time = time.Unix(from, 0)
+		}
+		if to != 0 {
+			r.AccessTo.Time = time.Unix(to, 0)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name     string
+		max      time.Duration
+		request  caIncomingRequest
+		expected bool
+	}{
+		{"below", 8 * time.Hour, window(1543388400, 1543388400+7*3600), true},
+		{"exactly", 8 * time.Hour, window(1543388400, 1543388400+8*3600), true},
+		{"above", 8 * time.Hour, window(1543388400, 1543388400+8*3600+1), false},
+		{"missing from", 8 * time.Hour, window(0, 1543388400), false},
+		{"missing to", 8 * time.Hour, window(1543388400, 0), false},
+		{"reversed", 8 * time.Hour, window(1543388400, 1543388399), false},
+		{"disabled", 0, window(1543388400, 1999999999), true},
+		{"disabled, unknown", 0, window(0, 0), true},
+	}
+
+	for _, test := range tests {
+		if got, _ := maxGrantFilter(test.max)(test.request); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+// Tests whether every filter gives its own reason for not accepting a request,
+// and no reason when it does.
+func TestFilterReasons(t *testing.T) {
+	safeRegex = regexp.MustCompile("^TEAM_")
+	defer func() { safeRegex = nil }()
+
+	r := newRequest("XX99XX", "root")
+	r.AccountDetails.Properties.Safe = "HR"
+	r.AccessFrom.Time = time.Unix(1543388400, 0)
+	r.AccessTo.Time = time.Unix(1543388400+9*3600, 0)
+
+	tests := []struct {
+		name     string
+		filter   requestFilter
+		expected string
+	}{
+		{"safe", safeFilter, skipSafe},
+		{"requestor", requestorFilter("AB12CD", false), skipUser},
+		{"target username", targetUsernameFilter(splitList("svc_deploy")), skipUsername},
+		{"prior use", priorUseFilter(true), skipPriorUse},
+		{"access window", accessWindowFilter(time.Unix(1543388401, 0), time.Time{}), skipWindow},
+		{"max grant", maxGrantFilter(8 * time.Hour), skipGrant},
+		{"first of all", allFilters(requestorFilter("XX99XX", false), priorUseFilter(true), safeFilter), skipPriorUse},
+	}
+
+	for _, test := range tests {
+		if ok, reason := test.filter(r); ok || reason != test.expected {
+			t.Errorf("%s: expected to be left out for %q, got %v, %q", test.name, test.expected, ok, reason)
+		}
+	}
+
+	if ok, reason := allFilters(requestorFilter("XX99XX", false), targetUsernameFilter(splitList("root")))(r); !ok || reason != "" {
+		t.Errorf("expected to be accepted without a reason, got %v, %q", ok, reason)
+	}
+}
+
+// Tests whether the reasons are summarized with the most frequent first.
+func TestSkipSummary(t *testing.T) {
+	reasons := map[string]int{skipWindow: 3, skipUser: 5, skipGrant: 3}
+	if got, want := skipSummary(reasons), "5 user-not-allowed, 3 grant-too-long, 3 outside-window"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if got := skipSummary(nil); got != "" {
+		t.Errorf("expected an empty summary, got %q", got)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// reservedHeaders are set by the program itself, and can't be given with
+// -header.
+var reservedHeaders = []string{"Authorization", "Content-Type"}
+
+// headerList is a repeatable flag of "Name: Value" headers.
+type headerList struct {
+	header http.Header
+}
+
+// headerFlag defines a repeatable header flag with the given name and usage.
+func headerFlag(name, usage string) *headerList {
+	h := &headerList{}
+	flag.Var(h, name, usage)
+	return h
+}
+
+func (h *headerList) String() string {
+	if h == nil {
+		return ""
+	}
+	var headers []string
+	for name, values := range h.header {
+		for _, v := range values {
+			headers = append(headers, name+": "+v)
+		}
+	}
+	return strings.Join(headers, ", ")
+}
+
+// Set adds the header, after checking its syntax.
+func (h *headerList) Set(s string) error {
+	name, value, err := parseHeader(s)
+	if err != nil {
+		return err
+	}
+	if h.header == nil {
+		h.header = make(http.Header)
+	}
+	h.header.Add(name, value)
+	return nil
+}
+
+// Header returns the headers given so far.
+func (h *headerList) Header() http.Header {
+	return h.header
+}
+
+// parseHeader parses a header given as "Name: Value".
+func parseHeader(s string) (string, string, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return "", "", fmt.Errorf("header '%s' is not of the form 'Name: Value'", s)
+	}
+	name, value := strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+
+	if name == "" {
+		return "", "", fmt.Errorf("header '%s' has no name", s)
+	}
+	for _, c := range name {
+		if !isTokenChar(c) {
+			return "", "", fmt.Errorf("header name '%s' contains invalid character %q", name, c)
+		}
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return "", "", fmt.Errorf("value of header '%s' contains a line break", name)
+	}
+	for _, r := range reservedHeaders {
+		if strings.EqualFold(name, r) {
+			return "", "", fmt.Errorf("header '%s' is set by pwv itself and can't be given", r)
+		}
+	}
+	return http.CanonicalHeaderKey(name), value, nil
+}
+
+// isTokenChar returns whether c may be used in a header name, see RFC 7230.
+func isTokenChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// Tests parsing valid and malformed headers.
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		input string
+		name  string
+		value string
+		err   bool
+	}{
+		{"X-Api-Key: abc123", "X-Api-Key", "abc123", false},
+		{"x-routing-zone:eu-west ", "X-Routing-Zone", "eu-west", false},
+		{"X-Empty:", "X-Empty", "", false},
+		{"X-Url: https://example.com:8443", "X-Url", "https://example.com:8443", false},
+		{"X-Api-Key abc123", "", "", true},
+		{": abc123", "", "", true},
+		{"X Api: abc", "", "", true},
+		{"X-Api-Key: abc\r\nX-Evil: 1", "", "", true},
+		{"Authorization: Bearer sneaky", "", "", true},
+		{"content-type: text/plain", "", "", true},
+	}
+
+	for _, test := range tests {
+		name, value, err := parseHeader(test.input)
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error: %v", test.input, err)
+			continue
+		}
+		if name != test.name || value != test.value {
+			t.Errorf("%q: expected %q %q, got %q %q", test.input, test.name, test.value, name, value)
+		}
+	}
+}
+
+// Tests whether the custom headers are sent with every request, without
+// overriding the headers set by pwv.
+func TestCustomHeaders(t *testing.T) {
+	var h headerList
+	for _, s := range []string{"X-Api-Key: abc123", "X-Zone: eu", "X-Zone: us"} {
+		if err := h.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Set("broken"); err == nil {
+		t.Error("expected a malformed header to be rejected")
+	}
+
+	var seen []http.Header
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Header.Clone())
+	}))
+	api.Headers = h.Header()
+	api.Headers.Set("Authorization", "not this one")
+
+	api.IncomingRequests()
+	api.ConfirmRequest(caIncomingRequest{RequestID: "1"}, "because")
+
+	if len(seen) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(seen))
+	}
+	for i, header := range seen {
+		if header.Get("X-Api-Key") != "abc123" || len(header.Values("X-Zone")) != 2 {
+			t.Errorf("request %d: expected the custom headers, got %v", i, header)
+		}
+		if header.Get("Authorization") != "test-logon-key" {
+			t.Errorf("request %d: expected the logon key to be kept, got %q", i, header.Get("Authorization"))
+		}
+	}
+	if seen[1].Get("Content-Type") != "application/json" {
+		t.Errorf("expected the content type to be kept, got %q", seen[1].Get("Content-Type"))
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxReasonHistory is the number of recently used reasons which are kept.
+const maxReasonHistory = 10
+
+// reasonHistoryPath returns the path of the file with recently used reasons.
+func reasonHistoryPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".pwv_reasons"), nil
+}
+
+// loadReasonHistory loads the recently used reasons from the file at path,
+// most recent first. A missing file results in an empty history.
+func loadReasonHistory(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var history []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			history = append(history, line)
+		}
+	}
+	return history, nil
+}
+
+// saveReason adds the reason to the front of the history file at path. A
+// reason which was used before moves to the front instead of showing up
+// twice. Only the most recent maxReasonHistory reasons are kept. The file is
+// only readable by the user, since reasons may tell something about what's
+// going on.
+func saveReason(path, reason string) error {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return nil
+	}
+
+	history, err := loadReasonHistory(path)
+	if err != nil {
+		return err
+	}
+
+	updated := []string{reason}
+	for _, r := range history {
+		if r != reason && len(updated) < maxReasonHistory {
+			updated = append(updated, r)
+		}
+	}
+
+	return ioutil.WriteFile(path, []byte(strings.Join(updated, "\n")+"\n"), 0600)
+}
+
+// promptReason shows the recent reasons and asks for the reason to confirm a
+// request with. A number picks one of the recent reasons, an empty answer
+// reuses the last one, and a single dash skips the request. Anything else is
+// used as the reason itself.
+func promptReason(in *bufio.Reader, out io.Writer, history []string) (string, bool, error) {
+	if len(history) > 0 {
+		fmt.Fprintln(out, "Recent reasons:")
+		for i, r := range history {
+			fmt.Fprintf(out, "  %d) %s\n", i+1, r)
+		}
+		fmt.Fprint(out, "Reason (number, text, empty for the last one, - to skip): ")
+	} else {
+		fmt.Fprint(out, "Reason (- to skip): ")
+	}
+
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", false, err
+		}
+		answer := strings.TrimSpace(line)
+
+		switch {
+		case answer == "-":
+			return "", false, nil
+		case answer == "" && len(history) > 0:
+			return history[0], true, nil
+		case answer == "":
+			fmt.Fprint(out, "Please enter a reason: ")
+			continue
+		}
+
+		if n, err := strconv.Atoi(answer); err == nil {
+			if n >= 1 && n <= len(history) {
+				return history[n-1], true, nil
+			}
+			fmt.Fprintf(out, "There is no reason %d, try again: ", n)
+			continue
+		}
+		return answer, true, nil
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Tests loading and saving the reason history, including de-duplication.
+func TestReasonHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reasons")
+
+	history, err := loadReasonHistory(path)
+	if err != nil || len(history) != 0 {
+		t.Fatalf("expected an empty history for a missing file, got %v (%v)", history, err)
+	}
+
+	for _, r := range []string{"Fixing prod", "Weekly maintenance", "Incident 1234", " Fixing prod ", ""} {
+		if err := saveReason(path, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err = loadReasonHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"Fixing prod", "Incident 1234", "Weekly maintenance"}
+	if !reflect.DeepEqual(history, expected) {
+		t.Errorf("expected %v, got %v", expected, history)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("expected permissions 0600, got %o", perm)
+	}
+}
+
+// Tests whether only the most recent reasons are kept.
+func TestReasonHistoryLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reasons")
+	for i := 0; i < maxReasonHistory+5; i++ {
+		if err := saveReason(path, strings.Repeat("x", i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := loadReasonHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != maxReasonHistory {
+		t.Errorf("expected %d reasons, got %d", maxReasonHistory, len(history))
+	}
+	if history[0] != strings.Repeat("x", maxReasonHistory+5) {
+		t.Errorf("expected the most recent reason first, got '%s'", history[0])
+	}
+}
+
+// Tests the answers accepted when prompting for a reason.
+func TestPromptReason(t *testing.T) {
+	history := []string{"Fixing prod", "Weekly maintenance"}
+
+	tests := []struct {
+		input    string
+		history  []string
+		reason   string
+		approved bool
+	}{
+		{"\n", history, "Fixing prod", true},
+		{"2\n", history, "Weekly maintenance", true},
+		{"5\n1\n", history, "Fixing prod", true},
+		{"Incident 1234\n", history, "Incident 1234", true},
+		{"-\n", history, "", false},
+		{"\nSomething\n", nil, "Something", true},
+		{"No newline", nil, "No newline", true},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		reason, approved, err := promptReason(bufio.NewReader(strings.NewReader(test.input)), &out, test.history)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.input, err)
+		}
+		if reason != test.reason || approved != test.approved {
+			t.Errorf("%q: expected '%s' (%v), got '%s' (%v)", test.input, test.reason, test.approved, reason, approved)
+		}
+	}
+
+	if _, _, err := promptReason(bufio.NewReader(strings.NewReader("")), &bytes.Buffer{}, history); err == nil {
+		t.Error("expected an error when there is no input")
+	}
+}
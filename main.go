@@ -3,141 +3,933 @@ package main
 // https://documenter.getpostman.com/view/998920/cyberark-rest-api-v10-public/2QrXnF#397e7f83-7605-d1b3-8077-9fd65f978537
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"syscall"
+	"text/template"
+	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
 )
 
 var (
-	flagBaseURL         = flag.String("url", "https://pwv.europe.intranet", "The base URL for the PasswordVault")
+	flagBaseURL         = flag.String("url", "https://pwv.europe.intranet", "The base URL for the PasswordVault. Separate multiple URLs by commas to fail over to the next when unreachable")
+	flagAPIPrefix       = flag.String("api-prefix", defaultAPIPrefix, "The context path the PasswordVault is served under, or / for the root")
 	flagUsername        = flag.String("username", "", "The username to login with into CyberArk")
 	flagPassword        = flag.String("password", "", "The password. If not given, it's requested by the program")
+	flagPinentry        = flag.String("pinentry", "", "Ask for the password using this pinentry program, such as /usr/bin/pinentry, instead of the terminal")
+	flagNetrc           = flag.Bool("netrc", false, "Read the username and password for the -url host from ~/.netrc")
 	flagAllowedCorpKeys = flag.String("allowedusers", "", "The allowed users, separated by commas")
-	flagConfirmReason   = flag.String("reason", "Automatically accepted! You're welcome.", "Confirmation reason.")
-	flagOperation       = flag.String("operation", "list", "Operation to execute (list|approve|retrieve)")
+	flagCaseSensitive   = flag.Bool("case-sensitive-users", false, "Match -allowedusers case-sensitively")
+	flagSafeRegex       = flag.String("safe-regex", "", "Restrict all operations to safes matching this regular expression")
+	flagTargetUsernames = flag.String("target-username", "", "Only approve requests for accounts with these usernames, separated by commas")
+	flagPriorUse        = flag.Bool("require-prior-use", false, "Only approve requests for accounts which were last used by the requestor")
+	flagSince           = flag.String("since", "", "Only list requests with access starting at or after this time (RFC3339, or relative such as 24h)")
+	flagUntil           = flag.String("until", "", "Only list requests with access ending at or before this time (RFC3339, or relative such as 24h)")
+	flagFormat          = flag.String("format", "text", "Output format of listed requests and platforms (text|csv|json). With json, the results of approving are written as JSON too")
+	flagShowContact     = flag.Bool("show-requestor", false, "Include the display name and email address of the requestor in listings, when known")
+	flagLimit           = flag.Int("limit", 0, "Maximum number of requests to list (0 lists all)")
+	flagMaskNames       = flag.Bool("mask-names", false, "Partially hide account names and addresses when listing and retrieving. Logs keep the full names")
+	flagTemplate        = flag.String("template", "", "Go template used to print each listed request, e.g. '{{.RequestID}} {{.AccountDetails.Properties.Safe}}'")
+	flagGrantDuration   = flag.Duration("grant-duration", 0, "Grant approved requests access for this long from confirming them, instead of the requested window")
+	flagGrantUntil      = flag.String("grant-until", "", "Grant approved requests access until this RFC3339 time, instead of the requested window")
+	flagWebhook         = flag.String("webhook", "", "URL to POST a JSON notification to after each confirmation")
+	flagInteractive     = flag.Bool("interactive", false, "Ask for the reason of every request to approve, offering recently used reasons")
+	flagMaxGrant        = flag.Duration("max-grant", 0, "Leave requests with an access window longer than this for manual review (0 disables the check)")
+	flagAtomicPerUser   = flag.Bool("atomic-per-user", false, "Approve the requests of a requestor all or nothing, rejecting the confirmed ones again when one fails")
+	flagFailFast        = flag.Bool("fail-fast", false, "Stop approving at the first request which fails to confirm, exiting with an error")
+	flagMaxPending      = flag.Int("max-pending", 0, "Refuse to approve anything when more than this many requests are pending (0 disables the guard)")
+	flagWatch           = flag.Duration("watch", 0, "Keep approving, polling for incoming requests with this interval (0 approves once)")
+	flagConfirmCooldown = flag.Duration("confirm-cooldown", time.Minute, "When watching, wait this long before retrying a request which failed to confirm. Doubles on every consecutive failure")
+	flagConfirmReason   = flag.String("reason", "Automatically accepted! You're welcome.", "Confirmation reason, or the reason for requesting access, which must then be given explicitly.")
+	flagAccountID       = flag.String("accountid", "", "The ID of the account to request access to, or to connect to")
+	flagRequestID       = flag.String("requestid", "", "The ID of my own request to cancel")
+	flagWaitInterval    = flag.Duration("wait-interval", 10*time.Second, "How often to check whether a request has been confirmed")
+	flagWaitTimeout     = flag.Duration("wait-timeout", 15*time.Minute, "How long to wait for a request to be confirmed")
+	flagOperation       = flag.String("operation", "list", "Deprecated, give the operation as subcommand instead (list|approve|retrieve|request-and-wait|cancel|diagnose|serverinfo|platforms|dump|connect)")
+	flagOutput          = flag.String("output", "", "File to write the output of the dump and connect operations to, instead of stdout")
+	flagConnComponent   = flag.String("connection-component", "PSM-RDP", "The PSM connection component to connect with, such as PSM-RDP or PSM-SSH")
+	flagDumpMine        = flag.Bool("dump-myrequests", false, "Also dump my own requests with the dump operation")
+	flagLogFormat       = flag.String("log-format", "text", "Format of informational output (text|json). With json, structured logs are written to stderr")
+	flagQuiet           = flag.Bool("quiet", false, "Suppress informational output, only print errors and summaries")
+	flagNoLogout        = flag.Bool("no-logout", false, "Do not log out at exit, leaving the session valid. Dangling sessions count against the session limits of the vault")
+	flagStats           = flag.Bool("stats", false, "Print the number of API calls, bytes and time spent per operation to stderr at exit")
+	flagMaxIdleConns    = flag.Int("max-idle-conns", 10, "Maximum number of idle (keep-alive) connections to the PasswordVault")
+	flagIdleConnTimeout = flag.Duration("idle-conn-timeout", 30*time.Second, "How long an idle connection is kept open")
+	flagDialTimeout     = flag.Duration("dial-timeout", 10*time.Second, "Maximum time for connecting to the PasswordVault")
+	flagTLSTimeout      = flag.Duration("tls-timeout", 10*time.Second, "Maximum time for the TLS handshake with the PasswordVault")
+	flagHeaders         = headerFlag("header", "Extra header to send with every request, as 'Name: Value'. Can be given multiple times")
+	flagForceHTTP1      = flag.Bool("force-http1", false, "Only use HTTP/1.1, for proxies which mishandle HTTP/2")
+	flagNoKeepAlives    = flag.Bool("disable-keepalives", false, "Disable HTTP keep-alives, using a new connection per request")
+	flagRecord          = flag.String("record", "", "Save every request and response to this directory, with credentials redacted, to reproduce issues with -replay")
+	flagReplay          = flag.String("replay", "", "Serve the responses recorded with -record from this directory, instead of talking to the PasswordVault")
 )
 
-func usage() {
-	fmt.Fprintf(os.Stderr, "pwv: \n")
-	flag.PrintDefaults()
-	fmt.Fprintf(os.Stderr, "Examples:\n\n")
-	fmt.Fprintf(os.Stderr, "pwv -username CORPKEY -operation approve -allowedusers KEY1,Key2,KEY3\n")
-	fmt.Fprintf(os.Stderr, "pwv -username CORPKEY -operation list\n")
+// allowedHosts is a comma separated list of the only hosts credentials may be
+// sent to. It's empty by default, allowing any host, and can be compiled in
+// to guard against mistyped or malicious URLs:
+//
+//	go build -ldflags "-X main.allowedHosts=pwv.europe.intranet"
+var allowedHosts string
+
+// flagGiven returns whether the flag with the given name was set on the
+// command line.
+func flagGiven(name string) bool {
+	given := globalFlags[name]
+	activeFlags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// stdin, stdout and stderr are used for all input and output. They are
+// variables so tests can provide input and capture the output.
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
+// logger writes structured JSON logs when -log-format json is given. It is
+// nil when using the default text output.
+var logger *slog.Logger
+
+// infof prints informational output to stdout, unless -quiet is set,
+// structured logging is used instead or stdout is reserved for JSON.
+func infof(format string, a ...interface{}) {
+	if *flagQuiet || logger != nil || *flagFormat == "json" {
+		return
+	}
+	fmt.Fprintf(stdout, format, a...)
+}
+
+// logEvent writes a structured log record, if structured logging is enabled.
+// Never pass secrets such as passwords or logon keys.
+func logEvent(level slog.Level, msg string, attrs ...slog.Attr) {
+	if logger == nil {
+		return
+	}
+	logger.LogAttrs(context.Background(), level, msg, attrs...)
 }
 
-func listIncoming(api *caAPI) {
+func listIncoming(api *caAPI, filter requestFilter, opts listOptions) {
 	incomingRequests, err := api.IncomingRequests()
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(stdout, err)
 		os.Exit(1)
-	} else {
-		if len(incomingRequests.IncomingRequests) == 0 {
-			fmt.Println("There are no incoming requests.")
+	}
+
+	filter = allFilters(safeFilter, filter)
+
+	var listed []caIncomingRequest
+	skipped := make(map[string]int)
+	for _, a := range incomingRequests.IncomingRequests {
+		if ok, reason := filter(a); ok {
+			listed = append(listed, a)
 		} else {
-			for _, a := range incomingRequests.IncomingRequests {
-				fmt.Printf("Incoming: %s, '%s' ('%s')\n",
-					a.RequestorUserName,
-					a.AccountDetails.Properties.Name,
-					a.UserReason)
-			}
+			skipped[reason]++
 		}
 	}
-}
 
-func approveIncoming(api *caAPI, allowedCorporateKeys string) {
-	corpkeys := strings.Trim(allowedCorporateKeys, " ")
-	if corpkeys == "" {
-		fmt.Fprintf(os.Stderr, "No corporate keys specified using `-users'.\n")
+	if len(listed) == 0 && opts.Format == "text" {
+		fmt.Fprintln(stdout, "There are no incoming requests.")
+		return
+	}
+
+	total := len(listed)
+	if opts.Limit > 0 && total > opts.Limit {
+		listed = listed[:opts.Limit]
+	}
+
+	if err := writeIncomingList(stdout, listed, opts); err != nil {
+		fmt.Fprintf(stderr, "Unable to print requests: %s\n", err)
 		os.Exit(1)
 	}
+	// The note goes to stderr, so the output stays valid in every format.
+	if len(listed) < total {
+		fmt.Fprintf(stderr, "Showing %d of %d requests, use -limit to show more.\n", len(listed), total)
+	}
+	if len(skipped) > 0 {
+		fmt.Fprintf(stderr, "Left out %d requests: %s\n", len(incomingRequests.IncomingRequests)-total, skipSummary(skipped))
+	}
+}
 
-	users := make(map[string]bool)
-	_ = users
-	for _, u := range strings.Split(corpkeys, ",") {
-		u = strings.Trim(u, " ")
-		u = strings.ToUpper(u)
-		users[u] = true
+// approveIncoming approves the incoming requests made by the allowed users
+// which pass the other filters. Requests which recently failed to confirm
+// are skipped while cooling down, unless cooldown is nil. An error is
+// returned when nothing could be approved at all.
+func approveIncoming(api *caAPI, allowedCorporateKeys string, cooldown *confirmCooldown) error {
+	corpkeys := strings.Trim(allowedCorporateKeys, " ")
+	if corpkeys == "" {
+		return fmt.Errorf("no corporate keys specified using `-allowedusers'")
 	}
 
 	incomingRequests, err := api.IncomingRequests()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
+	}
+
+	// A sudden flood of requests may indicate something fishy is going on.
+	// Rather not approve anything at all in that case.
+	pending := len(incomingRequests.IncomingRequests)
+	if *flagMaxPending > 0 && pending > *flagMaxPending {
+		fmt.Fprintf(stderr, "WARNING: %d requests are pending, which is more than the maximum of %d!\n", pending, *flagMaxPending)
+		fmt.Fprintf(stderr, "WARNING: Refusing to approve anything, please review the requests manually.\n")
+		return fmt.Errorf("too many pending requests (%d > %d)", pending, *flagMaxPending)
+	}
+
+	filter := allFilters(
+		safeFilter,
+		requestorFilter(corpkeys, *flagCaseSensitive),
+		targetUsernameFilter(splitList(*flagTargetUsernames)),
+		priorUseFilter(*flagPriorUse),
+	)
+
+	// Approve everything that passes the filters, using the same reason.
+	// Requests asking for too long access are left for manual review.
+	grantFilter := maxGrantFilter(*flagMaxGrant)
+	skipped := make(map[string]string)
+	decide := func(r caIncomingRequest) (bool, string, error) {
+		if ok, reason := filter(r); !ok {
+			skipped[r.RequestID] = reason
+			return false, "", nil
+		}
+		if ok, reason := grantFilter(r); !ok {
+			skipped[r.RequestID] = reason
+			return false, "", nil
+		}
+		if cooldown != nil && !cooldown.allowed(r.RequestID) {
+			skipped[r.RequestID] = skipCoolingDown
+			return false, "", nil
+		}
+		if *flagInteractive {
+			approve, reason, err := decideInteractively(r)
+			if !approve && err == nil {
+				skipped[r.RequestID] = skipDeclined
+			}
+			return approve, reason, err
+		}
+		return true, *flagConfirmReason, nil
+	}
+
+	var results []caApproval
+	if *flagAtomicPerUser {
+		results, err = api.ApproveRequestsPerUser(context.Background(), incomingRequests.IncomingRequests, decide, userFold(*flagCaseSensitive), rollbackReason)
 	} else {
-		if len(incomingRequests.IncomingRequests) == 0 {
-			fmt.Println("There are no incoming requests.")
-		} else {
-			for _, a := range incomingRequests.IncomingRequests {
-				requestor := strings.ToUpper(a.RequestorUserName)
-				if _, ok := users[requestor]; ok {
-					fmt.Printf("Confirming: %s, '%s' ('%s')... ", requestor, a.AccountDetails.Properties.Name, a.UserReason)
-					err := api.ConfirmRequest(a, *flagConfirmReason)
-					if err != nil {
-						fmt.Println("failed!")
-						fmt.Fprintf(os.Stderr, "Unable to confirm request: %s\n", err)
-					} else {
-						fmt.Println("ok!")
-					}
+		results, err = api.ApproveRequests(context.Background(), incomingRequests.IncomingRequests, decide)
+	}
+	// Whatever was handled before an error is still reported, since some
+	// requests may have been confirmed already.
+	if err != nil && len(results) == 0 {
+		return err
+	}
+	approveErr := err
+
+	// With JSON, only the results are written to stdout, as a single array.
+	var human io.Writer = stdout
+	jsonResults := make([]approveResult, 0, len(results))
+	if *flagFormat == "json" {
+		human = io.Discard
+	}
+
+	if len(results) == 0 {
+		fmt.Fprintln(human, "There are no incoming requests.")
+		if *flagFormat == "json" {
+			return writeApproveResults(stdout, jsonResults)
+		}
+		return nil
+	}
+
+	var confirmed, failed, ignored, rolledBack int
+	ignoredFor := make(map[string]int)
+	for _, res := range results {
+		a := res.Request
+		// Requestors differing in case only are different users when case
+		// sensitive, so they're shown as received.
+		requestor := userFold(*flagCaseSensitive)(a.RequestorUserName)
+		level, result := slog.LevelInfo, "ignored"
+		reason := skipped[a.RequestID]
+		if res.Aborted {
+			reason = skipAborted
+		}
+		if !res.Approved && reason != "" {
+			ignoredFor[reason]++
+		}
+		if res.Aborted {
+			ignored++
+			result = "aborted"
+			fmt.Fprintf(human, "Aborted: %s, request %s was not confirmed, since another request of this requestor failed\n", requestor, a.RequestID)
+		} else if res.RolledBack {
+			rolledBack++
+			result = "rolled back"
+			fmt.Fprintf(human, "Rolled back: %s, request %s was confirmed and rejected again, since another request of this requestor failed\n", requestor, a.RequestID)
+			if *flagWebhook != "" {
+				if err := notifyWebhook(webhookClient, *flagWebhook, newWebhookPayload("rollback", res, time.Now())); err != nil {
+					fmt.Fprintf(stderr, "Unable to notify webhook about request %s: %s\n", a.RequestID, err)
+				}
+			}
+		} else if res.Approved {
+			infof("Confirming: %s, '%s' ('%s')... ", requestor, a.AccountDetails.Properties.Name, a.UserReason)
+			if *flagWebhook != "" {
+				if err := notifyWebhook(webhookClient, *flagWebhook, newWebhookPayload("confirm", res, time.Now())); err != nil {
+					fmt.Fprintf(stderr, "Unable to notify webhook about request %s: %s\n", a.RequestID, err)
+				}
+			}
+			if cooldown != nil {
+				if res.Err != nil {
+					cooldown.failed(a.RequestID)
 				} else {
-					fmt.Printf("Ignoring: %s, \"%s\" from %v to %v\n", requestor, a.UserReason, a.AccessFrom, a.AccessTo)
+					cooldown.succeeded(a.RequestID)
+				}
+			}
+			if res.Err != nil {
+				failed++
+				level, result = slog.LevelError, "failed"
+				infof("failed!\n")
+				if logger == nil {
+					fmt.Fprintf(stderr, "Unable to confirm request %s: %s\n", a.RequestID, res.Err)
 				}
+			} else {
+				confirmed++
+				result = "confirmed"
+				infof("ok!\n")
 			}
+			if res.RollbackErr != nil {
+				level, result = slog.LevelError, "rollback failed"
+				fmt.Fprintf(stderr, "WARNING: Request %s of %s stays confirmed, unable to roll it back: %s\n", a.RequestID, requestor, res.RollbackErr)
+			}
+		} else if reason == skipGrant {
+			ignored++
+			result = "manual review"
+			window := "an unknown access window"
+			if d, ok := accessWindow(a); ok {
+				window = fmt.Sprintf("an access window of %v", d)
+			}
+			fmt.Fprintf(human, "Manual review: %s, request %s asks for %s, exceeding the maximum of %v\n", requestor, a.RequestID, window, *flagMaxGrant)
+		} else if reason == skipCoolingDown {
+			ignored++
+			result = "cooling down"
+			infof("Cooling down: %s, request %s failed to confirm before, not retrying yet\n", requestor, a.RequestID)
+		} else {
+			ignored++
+			infof("Ignoring: %s, \"%s\" from %v to %v (%s)\n", requestor, a.UserReason, a.AccessFrom, a.AccessTo, reason)
+		}
+
+		attrs := []slog.Attr{
+			slog.String("operation", "approve"),
+			slog.String("request_id", a.RequestID),
+			slog.String("requestor", requestor),
+			slog.String("account", a.AccountDetails.Properties.Name),
+			slog.String("result", result),
+			slog.Duration("latency", res.Duration),
+		}
+		if reason != "" {
+			attrs = append(attrs, slog.String("reason", reason))
+		}
+		var resErr error
+		if res.Err != nil {
+			resErr = res.Err
+		} else if res.RollbackErr != nil {
+			resErr = res.RollbackErr
+		}
+		if resErr != nil {
+			attrs = append(attrs, slog.String("error", resErr.Error()))
+		}
+		logEvent(level, "request handled", attrs...)
+
+		jr := approveResult{
+			RequestID: a.RequestID,
+			Requestor: requestor,
+			Account:   a.AccountDetails.Properties.Name,
+			Action:    "ignore",
+			Result:    result,
+			Reason:    reason,
 		}
+		if res.RolledBack {
+			jr.Action = "rollback"
+		} else if res.Approved {
+			jr.Action = "confirm"
+		}
+		if resErr != nil {
+			jr.Error = resErr.Error()
+		}
+		jsonResults = append(jsonResults, jr)
+	}
+	summary := fmt.Sprintf("ignored: %d", ignored)
+	if len(ignoredFor) > 0 {
+		summary += " (" + skipSummary(ignoredFor) + ")"
+	}
+	if *flagAtomicPerUser {
+		fmt.Fprintf(human, "Confirmed: %d, failed: %d, rolled back: %d, %s\n", confirmed, failed, rolledBack, summary)
+	} else {
+		fmt.Fprintf(human, "Confirmed: %d, failed: %d, %s\n", confirmed, failed, summary)
 	}
+	if *flagFormat == "json" {
+		if err := writeApproveResults(stdout, jsonResults); err != nil {
+			return err
+		}
+	}
+	return approveErr
 }
 
-func retrieve(ca *caAPI) {
-	reqs, err := ca.MyRequests()
+// rollbackReason is given when rejecting a request which was confirmed before
+// another request of the same requestor failed.
+const rollbackReason = "Rolled back: another request of this requestor could not be confirmed."
+
+// The reasons for the approve operation to ignore a request which the filters
+// did accept.
+const (
+	skipCoolingDown = "cooling-down"
+	skipDeclined    = "declined"
+	skipAborted     = "aborted"
+)
+
+// decideInteractively asks the user for the reason to confirm the request
+// with, offering the recently used reasons. The reason is remembered for the
+// next time.
+func decideInteractively(r caIncomingRequest) (bool, string, error) {
+	path, err := reasonHistoryPath()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return false, "", err
+	}
+	history, err := loadReasonHistory(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "Unable to load the reason history: %s\n", err)
 	}
 
-	if len(reqs.MyRequests) == 0 {
-		fmt.Println("There are no requests.")
-		os.Exit(0)
+	fmt.Fprintf(stdout, "Request %s from %s for '%s' ('%s'), from %v to %v\n",
+		r.RequestID, r.RequestorUserName, r.AccountDetails.Properties.Name, r.UserReason, r.AccessFrom, r.AccessTo)
+	reason, approve, err := promptReason(stdinReader(), stdout, history)
+	if err != nil || !approve {
+		return false, "", err
+	}
+
+	if err := saveReason(path, reason); err != nil {
+		fmt.Fprintf(stderr, "Unable to save the reason history: %s\n", err)
+	}
+	return true, reason, nil
+}
+
+// stdinBuffer reads stdin, and is reused so no buffered input gets lost
+// between prompts.
+var stdinBuffer *bufio.Reader
+
+// stdinReader returns the buffered reader of stdin.
+func stdinReader() *bufio.Reader {
+	if stdinBuffer == nil {
+		stdinBuffer = bufio.NewReader(stdin)
+	}
+	return stdinBuffer
+}
+
+// retrieve prints the passwords of all my requests. The reason is used for
+// accounts which require one to retrieve the password. Passwords which can't
+// be retrieved are reported on stderr, and result in an error once the others
+// are printed.
+func retrieve(ca *caAPI, reason string) error {
+	reqs, err := ca.MyRequests()
+	if err != nil {
+		return err
 	}
 
+	var allowed []caMyRequest
 	for _, r := range reqs.MyRequests {
-		passwd, err := ca.GetPassword(r)
+		if safeAllowed(r.AccountDetails.Properties.Safe) {
+			allowed = append(allowed, r)
+		}
+	}
+
+	if len(allowed) == 0 {
+		fmt.Fprintln(stdout, "There are no requests.")
+		return nil
+	}
+
+	failed := 0
+	for _, r := range allowed {
+		name := r.AccountDetails.Properties.Name
+		if *flagMaskNames {
+			name = maskMiddle(name)
+		}
+		passwd, err := ca.GetPassword(r, reason)
 		if err != nil {
-			// what
+			failed++
+			fmt.Fprintf(stderr, "Unable to retrieve the password of %s: %s\n", name, err)
 			continue
 		}
-		fmt.Printf("%s = %s\n", r.AccountDetails.Properties.Name, passwd)
+		printSecret(stdout, name+" = ", passwd)
 	}
+	if failed > 0 {
+		return fmt.Errorf("unable to retrieve %d of %d passwords", failed, len(allowed))
+	}
+	return nil
 }
 
-func logout(api *caAPI) {
-	err := api.Logout()
+// cancelRequest withdraws one of my requests. With -safe-regex, the request
+// must be for a safe which may be touched.
+func cancelRequest(api *caAPI, requestID string) error {
+	if safeRegex != nil {
+		reqs, err := api.MyRequests()
+		if err != nil {
+			return err
+		}
+		var found *caMyRequest
+		for i, r := range reqs.MyRequests {
+			if r.RequestID == requestID {
+				found = &reqs.MyRequests[i]
+				break
+			}
+		}
+		if found == nil {
+			return fmt.Errorf("request %s was not found, so its safe can't be checked against -safe-regex", requestID)
+		}
+		if safe := found.AccountDetails.Properties.Safe; !safeAllowed(safe) {
+			return fmt.Errorf("request %s is for safe '%s', which does not match -safe-regex", requestID, safe)
+		}
+	}
+	return api.DeleteMyRequest(requestID)
+}
+
+// printSecret writes the prefix and the secret on a line of its own, and
+// destroys the secret afterwards.
+func printSecret(w io.Writer, prefix string, s *secret) {
+	defer s.Destroy()
+	line := make([]byte, 0, len(prefix)+len(s.Bytes())+1)
+	line = append(line, prefix...)
+	line = append(line, s.Bytes()...)
+	line = append(line, '\n')
+	w.Write(line)
+	wipe(line)
+}
+
+// requestAndWait requests access to the account, waits until the request is
+// confirmed by polling my requests, and returns the password. An error is
+// returned when the request is rejected, or isn't confirmed within timeout.
+// The caller should destroy the password once used.
+func requestAndWait(api *caAPI, accountID, reason string, interval, timeout time.Duration) (*secret, error) {
+	created, err := api.CreateRequest(accountID, reason)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request: %s", err)
+	}
+	infof("Requested access to account %s (request %s), waiting for confirmation...\n", accountID, created.RequestID)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		reqs, err := api.MyRequests()
+		if err != nil {
+			return nil, err
+		}
+
+		var found *caMyRequest
+		for i, r := range reqs.MyRequests {
+			if r.RequestID == created.RequestID {
+				found = &reqs.MyRequests[i]
+				break
+			}
+		}
+
+		if found != nil && !safeAllowed(found.AccountDetails.Properties.Safe) {
+			// Don't leave the request pending for a safe which may not be
+			// touched.
+			err := fmt.Errorf("request %s is for safe '%s', which does not match -safe-regex", found.RequestID, found.AccountDetails.Properties.Safe)
+			if derr := api.DeleteMyRequest(found.RequestID); derr != nil {
+				return nil, fmt.Errorf("%s, and it could not be withdrawn: %s", err, derr)
+			}
+			return nil, err
+		}
+
+		if found != nil {
+			switch found.Status {
+			case caStatusConfirmed:
+				return api.GetPassword(*found, reason)
+			case caStatusRejected:
+				return nil, fmt.Errorf("request %s was rejected", found.RequestID)
+			case caStatusWaiting:
+			default:
+				return nil, fmt.Errorf("request %s will not be confirmed: %s", found.RequestID, found.StatusTitle)
+			}
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			return nil, fmt.Errorf("request %s was not confirmed within %v", created.RequestID, timeout)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// transportOptions contains the tunable settings of the HTTP transport.
+type transportOptions struct {
+	MaxIdleConns        int
+	IdleConnTimeout     time.Duration
+	DisableKeepAlives   bool
+	DialTimeout         time.Duration // Maximum time for setting up a TCP connection.
+	TLSHandshakeTimeout time.Duration // Maximum time for the TLS handshake.
+	ForceHTTP1          bool          // Never negotiate HTTP/2.
+}
+
+// newTransport creates the HTTP transport used for talking to the vault,
+// configured using the given options.
+func newTransport(opts transportOptions) *http.Transport {
+	// Create our own transport to discard any certificate errors since some
+	// companies injects their own cruft anyway.
+	dialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	tr := &http.Transport{
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: opts.TLSHandshakeTimeout,
+		MaxIdleConns:        opts.MaxIdleConns,
+		MaxIdleConnsPerHost: opts.MaxIdleConns,
+		IdleConnTimeout:     opts.IdleConnTimeout,
+		DisableKeepAlives:   opts.DisableKeepAlives,
+		// Go doesn't attempt HTTP/2 by itself once a custom dialer or TLS
+		// config is set, so ask for it explicitly.
+		ForceAttemptHTTP2: true,
+	}
+	if opts.ForceHTTP1 {
+		// A non-nil, empty map disables HTTP/2 altogether.
+		tr.ForceAttemptHTTP2 = false
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return tr
+}
+
+// diagnose performs a read-only check of the complete flow: logging in,
+// fetching the incoming requests and my requests, and logging out. Every
+// step is reported with its duration. It returns whether all steps passed.
+func diagnose(api *caAPI, username string, password *secret) bool {
+	passed := true
+	step := func(name string, f func() (string, error)) bool {
+		start := time.Now()
+		detail, err := f()
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			passed = false
+			fmt.Fprintf(stdout, "FAIL %-16s %8v  %s\n", name, elapsed, err)
+			return false
+		}
+		fmt.Fprintf(stdout, "PASS %-16s %8v  %s\n", name, elapsed, detail)
+		return true
+	}
+
+	ok := step("login", func() (string, error) {
+		return "logged in as " + username, api.Login(username, password)
+	})
+	if !ok {
+		fmt.Fprintln(stdout, "Diagnose failed: unable to login, skipped the remaining steps.")
+		return false
+	}
+
+	step("incoming requests", func() (string, error) {
+		resp, err := api.IncomingRequests()
+		return fmt.Sprintf("%d request(s)", len(resp.IncomingRequests)), err
+	})
+	step("my requests", func() (string, error) {
+		resp, err := api.MyRequests()
+		return fmt.Sprintf("%d request(s)", len(resp.MyRequests)), err
+	})
+	step("logout", func() (string, error) {
+		return "logged out", api.Logout()
+	})
+
+	if passed {
+		fmt.Fprintln(stdout, "Diagnose passed.")
+	} else {
+		fmt.Fprintln(stdout, "Diagnose failed.")
+	}
+	return passed
+}
+
+// checkAllowedHost returns an error when the host of the base URL is not one
+// of the comma separated allowlist. An empty allowlist allows any host.
+func checkAllowedHost(baseURL, allowlist string) error {
+	allowed := splitList(allowlist)
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
+	if !allowed[strings.ToUpper(u.Hostname())] {
+		return fmt.Errorf("host '%s' is not allowed, refusing to send credentials to it", u.Hostname())
+	}
+	return nil
+}
+
+// grantUntil determines until when approved requests are granted access,
+// given either a duration relative to now or an RFC3339 time. A zero time is
+// returned when neither is given. With a maximum grant, the access may not be
+// granted for longer than that.
+func grantUntil(duration time.Duration, until string, max time.Duration, now time.Time) (time.Time, error) {
+	if duration != 0 && until != "" {
+		return time.Time{}, fmt.Errorf("only one of -grant-duration and -grant-until can be given")
+	}
+
+	if duration != 0 {
+		if duration < 0 {
+			return time.Time{}, fmt.Errorf("grant duration must be positive, got %v", duration)
+		}
+		if max > 0 && duration > max {
+			return time.Time{}, fmt.Errorf("grant duration %v exceeds the maximum of %v given with -max-grant", duration, max)
+		}
+		return now.Add(duration), nil
+	}
+
+	if until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !t.After(now) {
+			return time.Time{}, fmt.Errorf("grant end time %s lies in the past", until)
+		}
+		if max > 0 && t.Sub(now) > max {
+			return time.Time{}, fmt.Errorf("grant end time %s lies further ahead than the maximum of %v given with -max-grant", until, max)
+		}
+		return t, nil
+	}
+
+	return time.Time{}, nil
+}
+
+// serverInfo prints the name and version of the vault.
+func serverInfo(api *caAPI) error {
+	info, err := api.ServerInfo()
 	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Server:  %s (%s)\n", info.ServerName, info.ServerID)
+	fmt.Fprintf(stdout, "Version: %s\n", info.ExternalVersion)
+	fmt.Fprintf(stdout, "Build:   %s\n", info.InternalVersion)
+	return nil
+}
+
+// listPlatforms prints the platforms of the vault in the given format.
+func listPlatforms(api *caAPI, format string) error {
+	platforms, err := api.Platforms()
+	if err != nil {
+		return fmt.Errorf("unable to get the platforms: %s", err)
+	}
+	if err := writePlatforms(stdout, platforms, format); err != nil {
+		return fmt.Errorf("unable to write the platforms: %s", err)
+	}
+	return nil
+}
+
+// dump writes the incoming requests response to w exactly as the vault sent
+// it. When mine is set, the own requests are included too, and both responses
+// are wrapped in a single object.
+func dump(api *caAPI, w io.Writer, mine bool) error {
+	incoming, err := api.IncomingRequestsRaw()
+	if err != nil {
+		return err
+	}
+	if !mine {
+		_, err = w.Write(incoming)
+		return err
+	}
+
+	myRequests, err := api.MyRequestsRaw()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "{\"IncomingRequests\":%s,\"MyRequests\":%s}\n", incoming, myRequests)
+	return err
+}
+
+// connect requests a PSM connection to the account, and writes the connection
+// file to w.
+func connect(api *caAPI, w io.Writer, accountID, component, reason string) error {
+	params := map[string]string{"ConnectionComponent": component}
+	if reason != "" {
+		params["reason"] = reason
+	}
+	file, err := api.PSMConnect(accountID, params)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(file)
+	return err
+}
+
+// createOutput opens the file given with -output for writing, or returns
+// stdout when none was given.
+func createOutput() (io.WriteCloser, error) {
+	if *flagOutput == "" {
+		return nopCloser{stdout}, nil
+	}
+	return os.OpenFile(*flagOutput, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+}
+
+// nopCloser is a writer with a Close method which does nothing.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// logout logs out of the vault, unless -no-logout is given, printing the
+// stats of the run afterwards when requested, as it's the last call made.
+func logout(api *caAPI) {
+	if *flagNoLogout {
+		fmt.Fprintln(stderr, "WARNING: Not logging out, the session stays valid and counts against the session limits of the vault.")
+	} else if err := api.Logout(); err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to logout: %s\n", err)
 	}
+	if *flagStats {
+		writeStats(stderr, api.Stats())
+	}
 }
 
 func main() {
 	flag.Usage = usage
-	flag.Parse()
+	if err := parseArgs(os.Args[1:]); err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(2)
+	}
+
+	switch *flagLogFormat {
+	case "text":
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(stderr, nil))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown log format '%s' given with -log-format\n", *flagLogFormat)
+		os.Exit(1)
+	}
 
-	if *flagUsername == "" {
+	since, err := parseTime(*flagSince, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid time given with -since: %s\n", err)
+		os.Exit(1)
+	}
+	until, err := parseTime(*flagUntil, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid time given with -until: %s\n", err)
+		os.Exit(1)
+	}
+
+	if *flagSafeRegex != "" {
+		safeRegex, err = regexp.Compile(*flagSafeRegex)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid regular expression given with -safe-regex: %s\n", err)
+			os.Exit(1)
+		}
+		// The dump is written verbatim, and the safe of the account to connect
+		// to isn't known up front, so neither can be restricted to safes.
+		if *flagOperation == "dump" || *flagOperation == "connect" {
+			fmt.Fprintf(os.Stderr, "The %s operation cannot be combined with -safe-regex\n", *flagOperation)
+			os.Exit(1)
+		}
+	}
+
+	if *flagRecord != "" && *flagReplay != "" {
+		fmt.Fprintln(os.Stderr, "Only one of -record and -replay can be given")
+		os.Exit(1)
+	}
+
+	if !strings.HasPrefix(*flagAPIPrefix, "/") {
+		fmt.Fprintf(os.Stderr, "The -api-prefix '%s' must start with a /\n", *flagAPIPrefix)
+		os.Exit(1)
+	}
+
+	if !validFormat(*flagFormat) {
+		fmt.Fprintf(os.Stderr, "Unknown format '%s' given with -format\n", *flagFormat)
+		os.Exit(1)
+	}
+
+	var tmpl *template.Template
+	if *flagTemplate != "" {
+		tmpl, err = parseTemplate(*flagTemplate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid template given with -template: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	grant, err := grantUntil(*flagGrantDuration, *flagGrantUntil, *flagMaxGrant, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid grant: %s\n", err)
+		os.Exit(1)
+	}
+
+	var baseURLs []string
+	for _, u := range strings.Split(*flagBaseURL, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			baseURLs = append(baseURLs, u)
+		}
+	}
+	if len(baseURLs) == 0 {
+		fmt.Fprintln(os.Stderr, "No base URL given with -url")
+		os.Exit(1)
+	}
+	for _, u := range baseURLs {
+		if err := checkAllowedHost(u, allowedHosts); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid URL given with -url: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// The password is kept as a string until it's known, to be turned into a
+	// secret as soon as possible.
+	username, password := *flagUsername, *flagPassword
+
+	if *flagNetrc {
+		var host string
+		if u, err := url.Parse(baseURLs[0]); err == nil {
+			host = u.Hostname()
+		}
+		entry, found, err := readNetrc(host)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to use netrc: %s\n", err)
+		} else if found {
+			username, password = mergeNetrc(username, password, entry)
+		}
+	}
+
+	if username == "" {
 		fmt.Fprintln(os.Stderr, "No username given with -username")
 		os.Exit(1)
 	}
 
-	var password string
+	if password == "" && *flagPinentry != "" {
+		pwd, err := pinentry(*flagPinentry, "Enter the CyberArk password of "+username, "Password:")
+		if errors.Is(err, errNoPinentry) {
+			fmt.Fprintf(os.Stderr, "%s, asking for the password on the terminal instead\n", err)
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read the password: %s\n", err)
+			os.Exit(1)
+		}
+		password = pwd
+	}
 
-	if *flagPassword != "" {
-		password = *flagPassword
+	var passwd *secret
+	if password != "" {
+		passwd = newSecret([]byte(password))
+	} else if *flagReplay != "" {
+		// A replayed session never sends the password anywhere.
+		passwd = newSecret(nil)
 	} else {
-		fmt.Printf("%s's Password: ", *flagUsername)
+		fmt.Printf("%s's Password: ", username)
 		pwd, err := terminal.ReadPassword(int(syscall.Stdin))
-		password = string(pwd)
+		passwd = newSecret(pwd)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -145,28 +937,192 @@ func main() {
 		fmt.Println()
 	}
 
-	// Create our own transport to discard any certificate errors since some
-	// companies injects their own cruft anyway.
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	tr := newTransport(transportOptions{
+		MaxIdleConns:        *flagMaxIdleConns,
+		IdleConnTimeout:     *flagIdleConnTimeout,
+		DisableKeepAlives:   *flagNoKeepAlives,
+		DialTimeout:         *flagDialTimeout,
+		TLSHandshakeTimeout: *flagTLSTimeout,
+		ForceHTTP1:          *flagForceHTTP1,
+	})
+
+	var rt http.RoundTripper = tr
+	if *flagRecord != "" {
+		var custom []string
+		for name := range flagHeaders.Header() {
+			custom = append(custom, name)
+		}
+		rec, err := newRecorder(tr, *flagRecord, custom)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to record the session: %s\n", err)
+			os.Exit(1)
+		}
+		rt = rec
+	} else if *flagReplay != "" {
+		rep, err := newReplayer(*flagReplay)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to replay the session: %s\n", err)
+			os.Exit(1)
+		}
+		rt = rep
 	}
 
 	api := caAPI{}
-	api.Base = *flagBaseURL
-	api.Client = http.Client{Transport: tr}
+	api.Base = baseURLs[0]
+	api.Fallbacks = baseURLs[1:]
+	api.Client = http.Client{Transport: rt}
+	// A grant duration counts from every confirmation, which matters when
+	// watching, so only the end time is fixed up front.
+	if *flagGrantDuration != 0 {
+		api.GrantDuration = *flagGrantDuration
+	} else {
+		api.GrantUntil = grant
+	}
+	api.FailFast = *flagFailFast
+	api.Headers = flagHeaders.Header()
+	api.APIPrefix = *flagAPIPrefix
 
-	err := api.Login(*flagUsername, password)
+	if *flagOperation == "diagnose" {
+		ok := diagnose(&api, username, passwd)
+		passwd.Destroy()
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	start := time.Now()
+	err = api.Login(username, passwd)
+	passwd.Destroy()
 	if err != nil {
+		logEvent(slog.LevelError, "login failed",
+			slog.String("operation", "login"),
+			slog.String("result", "failed"),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("error", err.Error()))
 		fmt.Printf("Could not login: %s\n", err)
 		os.Exit(1)
 	}
+	logEvent(slog.LevelInfo, "logged in",
+		slog.String("operation", "login"),
+		slog.String("result", "ok"),
+		slog.Duration("latency", time.Since(start)))
 	defer logout(&api)
 
 	if *flagOperation == "list" {
-		listIncoming(&api)
+		listIncoming(&api, accessWindowFilter(since, until), listOptions{
+			Format:      *flagFormat,
+			Template:    tmpl,
+			ShowContact: *flagShowContact,
+			Limit:       *flagLimit,
+			MaskNames:   *flagMaskNames,
+		})
 	} else if *flagOperation == "approve" {
-		approveIncoming(&api, *flagAllowedCorpKeys)
+		cooldown := newConfirmCooldown(*flagConfirmCooldown)
+		for {
+			err := approveIncoming(&api, *flagAllowedCorpKeys, cooldown)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to approve: %s\n", err)
+				if *flagWatch == 0 || *flagFailFast {
+					logout(&api)
+					os.Exit(1)
+				}
+			}
+			if *flagWatch == 0 {
+				break
+			}
+			time.Sleep(*flagWatch)
+		}
 	} else if *flagOperation == "retrieve" {
-		retrieve(&api)
+		// The default reason is meant for confirming, so only pass along a
+		// reason which was given explicitly.
+		var reason string
+		if flagGiven("reason") {
+			reason = *flagConfirmReason
+		}
+		if err := retrieve(&api, reason); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			logout(&api)
+			os.Exit(1)
+		}
+	} else if *flagOperation == "request-and-wait" {
+		if *flagAccountID == "" {
+			fmt.Fprintln(os.Stderr, "No account ID given with -accountid")
+			logout(&api)
+			os.Exit(1)
+		}
+		// The default reason is meant for confirming, and would end up as the
+		// justification of the request.
+		if !flagGiven("reason") {
+			fmt.Fprintln(os.Stderr, "No reason given with -reason")
+			logout(&api)
+			os.Exit(1)
+		}
+		passwd, err := requestAndWait(&api, *flagAccountID, *flagConfirmReason, *flagWaitInterval, *flagWaitTimeout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			logout(&api)
+			os.Exit(1)
+		}
+		printSecret(stdout, "", passwd)
+	} else if *flagOperation == "cancel" {
+		if *flagRequestID == "" {
+			fmt.Fprintln(os.Stderr, "No request ID given with -requestid")
+			logout(&api)
+			os.Exit(1)
+		}
+		if err := cancelRequest(&api, *flagRequestID); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to cancel request: %s\n", err)
+			logout(&api)
+			os.Exit(1)
+		}
+		fmt.Fprintf(stdout, "Cancelled request %s.\n", *flagRequestID)
+	} else if *flagOperation == "serverinfo" {
+		if err := serverInfo(&api); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to get the server info: %s\n", err)
+			logout(&api)
+			os.Exit(1)
+		}
+	} else if *flagOperation == "platforms" {
+		if err := listPlatforms(&api, *flagFormat); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			logout(&api)
+			os.Exit(1)
+		}
+	} else if *flagOperation == "dump" {
+		w, err := createOutput()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create output file: %s\n", err)
+			logout(&api)
+			os.Exit(1)
+		}
+		defer w.Close()
+		if err := dump(&api, w, *flagDumpMine); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to dump requests: %s\n", err)
+			logout(&api)
+			os.Exit(1)
+		}
+	} else if *flagOperation == "connect" {
+		if *flagAccountID == "" {
+			fmt.Fprintln(os.Stderr, "No account ID given with -accountid")
+			logout(&api)
+			os.Exit(1)
+		}
+		w, err := createOutput()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create output file: %s\n", err)
+			logout(&api)
+			os.Exit(1)
+		}
+		defer w.Close()
+		var reason string
+		if flagGiven("reason") {
+			reason = *flagConfirmReason
+		}
+		if err := connect(&api, w, *flagAccountID, *flagConnComponent, reason); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to connect: %s\n", err)
+			logout(&api)
+			os.Exit(1)
+		}
 	}
 }
@@ -0,0 +1,1019 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestAPI starts a mock password vault using the given handler and
+// returns a logged in caAPI pointing to it.
+func newTestAPI(t *testing.T, handler http.Handler) *caAPI {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	api := &caAPI{}
+	api.Base = server.URL
+	api.Client = *server.Client()
+	api.LogonKey = "test-logon-key"
+	return api
+}
+
+// captureOutput redirects stdout and stderr to buffers for the duration of
+// the test.
+func captureOutput(t *testing.T) (*bytes.Buffer, *bytes.Buffer) {
+	out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+	oldOut, oldErr := stdout, stderr
+	stdout, stderr = out, errOut
+	t.Cleanup(func() {
+		stdout, stderr = oldOut, oldErr
+	})
+	return out, errOut
+}
+
+// incomingRequestsHandler serves the given incoming requests, and confirms
+// all of them except the request IDs in failing.
+func incomingRequestsHandler(requests string, failing ...string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/PasswordVault/API/IncomingRequests", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"IncomingRequests": [%s]}`, requests)
+	})
+	mux.HandleFunc("/PasswordVault/API/IncomingRequests/", func(w http.ResponseWriter, r *http.Request) {
+		for _, id := range failing {
+			if strings.Contains(r.URL.Path, "/"+id+"/") {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"ErrorCode": "PASWS001E", "ErrorMessage": "Nope"}`)
+				return
+			}
+		}
+	})
+	return mux
+}
+
+const mixedRequests = `
+	{"RequestID": "1", "RequestorUserName": "ab12cd", "UserReason": "because"},
+	{"RequestID": "2", "RequestorUserName": "EF34GH", "UserReason": "why not"},
+	{"RequestID": "3", "RequestorUserName": "XX99XX", "UserReason": "let me in"}`
+
+// Tests whether quiet mode only prints errors and the summary.
+func TestApproveQuiet(t *testing.T) {
+	api := newTestAPI(t, incomingRequestsHandler(mixedRequests, "2"))
+	out, errOut := captureOutput(t)
+
+	*flagQuiet = true
+	defer func() { *flagQuiet = false }()
+
+	approveIncoming(api, "AB12CD,ef34gh", nil)
+
+	if got, want := out.String(), "Confirmed: 1, failed: 1, ignored: 1 (1 user-not-allowed)\n"; got != want {
+		t.Errorf("expected stdout %q, got %q", want, got)
+	}
+	if !strings.Contains(errOut.String(), "Unable to confirm request 2") {
+		t.Errorf("expected confirmation error on stderr, got %q", errOut.String())
+	}
+}
+
+// Tests whether informational output is printed when not in quiet mode.
+func TestApproveNotQuiet(t *testing.T) {
+	api := newTestAPI(t, incomingRequestsHandler(mixedRequests, "2"))
+	out, _ := captureOutput(t)
+
+	approveIncoming(api, "AB12CD,ef34gh", nil)
+
+	for _, s := range []string{"Confirming: AB12CD", "ok!", "failed!", "Ignoring: XX99XX", "Confirmed: 1, failed: 1, ignored: 1"} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("expected %q in output, got %q", s, out.String())
+		}
+	}
+}
+
+// Tests whether the transport is configured from the options.
+func TestNewTransport(t *testing.T) {
+	tr := newTransport(transportOptions{
+		MaxIdleConns:        3,
+		IdleConnTimeout:     5 * time.Second,
+		DisableKeepAlives:   true,
+		DialTimeout:         2 * time.Second,
+		TLSHandshakeTimeout: 4 * time.Second,
+	})
+
+	if tr.MaxIdleConns != 3 || tr.MaxIdleConnsPerHost != 3 {
+		t.Errorf("incorrect max idle conns: %d/%d", tr.MaxIdleConns, tr.MaxIdleConnsPerHost)
+	}
+	if tr.IdleConnTimeout != 5*time.Second {
+		t.Errorf("incorrect idle conn timeout: %v", tr.IdleConnTimeout)
+	}
+	if !tr.DisableKeepAlives {
+		t.Error("expected keep-alives to be disabled")
+	}
+	if tr.TLSHandshakeTimeout != 4*time.Second {
+		t.Errorf("incorrect TLS handshake timeout: %v", tr.TLSHandshakeTimeout)
+	}
+	if tr.DialContext == nil {
+		t.Error("expected a dialer to be configured")
+	}
+	if tr.TLSClientConfig == nil || !tr.TLSClientConfig.InsecureSkipVerify {
+		t.Error("expected certificate verification to be skipped")
+	}
+	if !tr.ForceAttemptHTTP2 || tr.TLSNextProto != nil {
+		t.Error("expected HTTP/2 to be negotiated")
+	}
+}
+
+// Tests whether HTTP/2 is disabled when forcing HTTP/1.1.
+func TestNewTransportForceHTTP1(t *testing.T) {
+	tr := newTransport(transportOptions{ForceHTTP1: true})
+	if tr.ForceAttemptHTTP2 {
+		t.Error("expected HTTP/2 not to be attempted")
+	}
+	if tr.TLSNextProto == nil || len(tr.TLSNextProto) != 0 {
+		t.Errorf("expected an empty TLSNextProto map, got %v", tr.TLSNextProto)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	for _, force := range []bool{false, true} {
+		client := http.Client{Transport: newTransport(transportOptions{ForceHTTP1: force})}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if want := map[bool]int{false: 2, true: 1}[force]; resp.ProtoMajor != want {
+			t.Errorf("force-http1 %v: expected HTTP/%d, got %s", force, want, resp.Proto)
+		}
+	}
+}
+
+// Tests computing and validating the grant expiry.
+func TestGrantUntil(t *testing.T) {
+	now := time.Unix(1543388400, 0)
+
+	tests := []struct {
+		duration  time.Duration
+		until     string
+		max       time.Duration
+		expected  time.Time
+		expectErr bool
+	}{
+		{0, "", 0, time.Time{}, false},
+		{2 * time.Hour, "", 0, now.Add(2 * time.Hour), false},
+		{-time.Hour, "", 0, time.Time{}, true},
+		{0, "2018-11-30T18:00:00Z", 0, time.Unix(1543600800, 0), false},
+		{0, "2018-11-01T00:00:00Z", 0, time.Time{}, true},
+		{0, "tomorrow", 0, time.Time{}, true},
+		{time.Hour, "2018-11-30T18:00:00Z", 0, time.Time{}, true},
+		{8 * time.Hour, "", 8 * time.Hour, now.Add(8 * time.Hour), false},
+		{72 * time.Hour, "", 8 * time.Hour, time.Time{}, true},
+		{0, "2018-11-30T18:00:00Z", 8 * time.Hour, time.Time{}, true},
+		{0, "2018-11-30T18:00:00Z", 72 * time.Hour, time.Unix(1543600800, 0), false},
+	}
+
+	for _, test := range tests {
+		got, err := grantUntil(test.duration, test.until, test.max, now)
+		if (err != nil) != test.expectErr {
+			t.Errorf("%v/%q: unexpected error result: %v", test.duration, test.until, err)
+		}
+		if !got.Equal(test.expected) {
+			t.Errorf("%v/%q: expected %v, got %v", test.duration, test.until, test.expected, got)
+		}
+	}
+}
+
+// vaultHandler is a mock vault which accepts logins and serves empty request
+// lists, unless failing contains the path of the endpoint.
+func vaultHandler(failing ...string) http.Handler {
+	fail := func(w http.ResponseWriter, r *http.Request) bool {
+		for _, p := range failing {
+			if r.URL.Path == p {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, `{"ErrorCode": "PASWS999E", "ErrorMessage": "Broken"}`)
+				return true
+			}
+		}
+		return false
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/PasswordVault/WebServices/auth/Cyberark/CyberArkAuthenticationService.svc/Logon", func(w http.ResponseWriter, r *http.Request) {
+		if !fail(w, r) {
+			fmt.Fprint(w, `{"CyberArkLogonResult": "test-logon-key"}`)
+		}
+	})
+	mux.HandleFunc("/PasswordVault/WebServices/auth/Cyberark/CyberArkAuthenticationService.svc/Logoff", func(w http.ResponseWriter, r *http.Request) {
+		fail(w, r)
+	})
+	mux.HandleFunc("/PasswordVault/API/IncomingRequests", func(w http.ResponseWriter, r *http.Request) {
+		if !fail(w, r) {
+			fmt.Fprint(w, `{"IncomingRequests": [{"RequestID": "1"}, {"RequestID": "2"}]}`)
+		}
+	})
+	mux.HandleFunc("/PasswordVault/API/MyRequests", func(w http.ResponseWriter, r *http.Request) {
+		if !fail(w, r) {
+			fmt.Fprint(w, `{"MyRequests": [{"Status": 2}]}`)
+		}
+	})
+	return mux
+}
+
+// Tests the diagnose flow when everything works.
+func TestDiagnose(t *testing.T) {
+	api := newTestAPI(t, vaultHandler())
+	out, _ := captureOutput(t)
+
+	if !diagnose(api, "AB12CD", newSecret([]byte("secret"))) {
+		t.Errorf("expected diagnose to pass, output:\n%s", out)
+	}
+	for _, s := range []string{"PASS login", "PASS incoming requests", "2 request(s)", "PASS my requests", "1 request(s)", "PASS logout", "Diagnose passed."} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("expected %q in output:\n%s", s, out)
+		}
+	}
+}
+
+// Tests the diagnose flow when a step fails.
+func TestDiagnoseFailure(t *testing.T) {
+	api := newTestAPI(t, vaultHandler("/PasswordVault/API/MyRequests"))
+	out, _ := captureOutput(t)
+
+	if diagnose(api, "AB12CD", newSecret([]byte("secret"))) {
+		t.Errorf("expected diagnose to fail, output:\n%s", out)
+	}
+	for _, s := range []string{"PASS incoming requests", "FAIL my requests", "PASWS999E", "PASS logout", "Diagnose failed."} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("expected %q in output:\n%s", s, out)
+		}
+	}
+}
+
+// Tests whether the diagnose flow stops when logging in fails.
+func TestDiagnoseLoginFailure(t *testing.T) {
+	api := newTestAPI(t, vaultHandler("/PasswordVault/WebServices/auth/Cyberark/CyberArkAuthenticationService.svc/Logon"))
+	out, _ := captureOutput(t)
+
+	if diagnose(api, "AB12CD", newSecret([]byte("secret"))) {
+		t.Error("expected diagnose to fail")
+	}
+	if strings.Contains(out.String(), "incoming requests") {
+		t.Errorf("expected the remaining steps to be skipped, output:\n%s", out)
+	}
+}
+
+// Tests whether structured logging emits valid JSON with the expected keys.
+func TestApproveJSONLogs(t *testing.T) {
+	api := newTestAPI(t, incomingRequestsHandler(mixedRequests, "2"))
+	out, errOut := captureOutput(t)
+
+	logger = slog.New(slog.NewJSONHandler(stderr, nil))
+	defer func() { logger = nil }()
+
+	approveIncoming(api, "AB12CD,ef34gh", nil)
+
+	if got, want := out.String(), "Confirmed: 1, failed: 1, ignored: 1 (1 user-not-allowed)\n"; got != want {
+		t.Errorf("expected only the summary on stdout %q, got %q", want, got)
+	}
+
+	lines := strings.Split(strings.TrimSpace(errOut.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 log lines, got %d:\n%s", len(lines), errOut)
+	}
+
+	results := map[string]string{}
+	for _, line := range lines {
+		record := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid JSON log line %q: %s", line, err)
+		}
+		for _, key := range []string{"time", "level", "msg", "operation", "request_id", "requestor", "result", "latency"} {
+			if _, ok := record[key]; !ok {
+				t.Errorf("expected key '%s' in %q", key, line)
+			}
+		}
+		results[record["request_id"].(string)] = record["result"].(string)
+	}
+
+	expected := map[string]string{"1": "confirmed", "2": "failed", "3": "ignored"}
+	for id, result := range expected {
+		if results[id] != result {
+			t.Errorf("request %s: expected result '%s', got '%s'", id, result, results[id])
+		}
+	}
+	if strings.Contains(errOut.String(), "test-logon-key") {
+		t.Error("expected the logon key not to be logged")
+	}
+}
+
+// Tests whether approving is refused when too many requests are pending.
+func TestApproveMaxPending(t *testing.T) {
+	defer func() { *flagMaxPending = 0 }()
+
+	tests := []struct {
+		maxPending int
+		expectErr  bool
+	}{
+		{0, false},
+		{2, true},
+		{3, false},
+		{4, false},
+	}
+
+	for _, test := range tests {
+		var confirms int
+		handler := incomingRequestsHandler(mixedRequests)
+		api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/Confirm") {
+				confirms++
+			}
+			handler.ServeHTTP(w, r)
+		}))
+		_, errOut := captureOutput(t)
+
+		*flagMaxPending = test.maxPending
+		err := approveIncoming(api, "AB12CD,EF34GH", nil)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("max %d: expected an error", test.maxPending)
+			}
+			if confirms != 0 {
+				t.Errorf("max %d: expected nothing to be confirmed, got %d", test.maxPending, confirms)
+			}
+			if !strings.Contains(errOut.String(), "WARNING") {
+				t.Errorf("max %d: expected a warning, got %q", test.maxPending, errOut)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("max %d: unexpected error: %s", test.maxPending, err)
+		}
+		if confirms != 2 {
+			t.Errorf("max %d: expected 2 confirmations, got %d", test.maxPending, confirms)
+		}
+	}
+}
+
+// requestor is a stateful mock vault for the requesting side: a created
+// request stays waiting for a number of polls, after which it gets the final
+// status.
+type requestor struct {
+	waitPolls   int
+	finalStatus int
+	safe        string
+	polls       int
+	created     caCreateRequest
+	deleted     []string
+}
+
+func (m *requestor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/PasswordVault/API/MyRequests" && r.Method == "POST":
+		json.NewDecoder(r.Body).Decode(&m.created)
+		fmt.Fprint(w, `{"RequestID": "42", "Status": 1}`)
+	case r.URL.Path == "/PasswordVault/API/MyRequests":
+		m.polls++
+		status := caStatusWaiting
+		if m.polls > m.waitPolls {
+			status = m.finalStatus
+		}
+		fmt.Fprintf(w, `{"MyRequests": [
+			{"RequestID": "41", "Status": 2},
+			{"RequestID": "42", "Status": %d, "StatusTitle": "Whatever", "AccountDetails": {"AccountID": "%s", "Properties": {"Safe": "%s"}}}
+		]}`, status, m.created.AccountID, m.safe)
+	case strings.HasPrefix(r.URL.Path, "/PasswordVault/API/MyRequests/") && r.Method == "DELETE":
+		m.deleted = append(m.deleted, strings.TrimPrefix(r.URL.Path, "/PasswordVault/API/MyRequests/"))
+	case r.URL.Path == "/PasswordVault/WebServices/PIMServices.svc/Accounts/12_3/Credentials":
+		fmt.Fprint(w, "hunter2")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Tests requesting access and retrieving the password once confirmed.
+func TestRequestAndWaitConfirmed(t *testing.T) {
+	mock := &requestor{waitPolls: 2, finalStatus: caStatusConfirmed}
+	api := newTestAPI(t, mock)
+	captureOutput(t)
+
+	passwd, err := requestAndWait(api, "12_3", "Fixing prod", time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(passwd.Bytes()) != "hunter2" {
+		t.Errorf("expected the password, got '%s'", passwd.Bytes())
+	}
+	if mock.created.AccountID != "12_3" || mock.created.Reason != "Fixing prod" {
+		t.Errorf("unexpected create request %+v", mock.created)
+	}
+	if mock.polls != 3 {
+		t.Errorf("expected 3 polls, got %d", mock.polls)
+	}
+}
+
+// Tests whether a rejected request results in an error.
+func TestRequestAndWaitRejected(t *testing.T) {
+	api := newTestAPI(t, &requestor{waitPolls: 1, finalStatus: caStatusRejected})
+	captureOutput(t)
+
+	_, err := requestAndWait(api, "12_3", "Fixing prod", time.Millisecond, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("expected a rejection error, got %v", err)
+	}
+}
+
+// Tests whether waiting stops after the timeout.
+func TestRequestAndWaitTimeout(t *testing.T) {
+	mock := &requestor{waitPolls: 1000, finalStatus: caStatusConfirmed}
+	api := newTestAPI(t, mock)
+	captureOutput(t)
+
+	_, err := requestAndWait(api, "12_3", "Fixing prod", 5*time.Millisecond, 20*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "not confirmed within") {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+	if mock.polls > 5 {
+		t.Errorf("expected polling to stop at the timeout, got %d polls", mock.polls)
+	}
+}
+
+// Tests whether a request for a safe not matching -safe-regex is withdrawn,
+// instead of being left pending.
+func TestRequestAndWaitSafeRegex(t *testing.T) {
+	safeRegex = regexp.MustCompile("^TEAM_")
+	defer func() { safeRegex = nil }()
+
+	mock := &requestor{finalStatus: caStatusConfirmed, safe: "HR_PAYROLL"}
+	api := newTestAPI(t, mock)
+	captureOutput(t)
+
+	_, err := requestAndWait(api, "12_3", "Fixing prod", time.Millisecond, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "does not match -safe-regex") {
+		t.Errorf("expected a safe error, got %v", err)
+	}
+	if len(mock.deleted) != 1 || mock.deleted[0] != "42" {
+		t.Errorf("expected request 42 to be withdrawn, got %v", mock.deleted)
+	}
+}
+
+// Tests whether only requests for safes matching -safe-regex are cancelled.
+func TestCancelSafeRegex(t *testing.T) {
+	safeRegex = regexp.MustCompile("^TEAM_")
+	defer func() { safeRegex = nil }()
+
+	mock := &requestor{safe: "HR_PAYROLL"}
+	api := newTestAPI(t, mock)
+
+	if err := cancelRequest(api, "42"); err == nil || !strings.Contains(err.Error(), "does not match -safe-regex") {
+		t.Errorf("expected a safe error, got %v", err)
+	}
+	if err := cancelRequest(api, "43"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected an unknown request to be refused, got %v", err)
+	}
+	if len(mock.deleted) != 0 {
+		t.Errorf("expected nothing to be cancelled, got %v", mock.deleted)
+	}
+
+	mock.safe = "TEAM_APP"
+	if err := cancelRequest(api, "42"); err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.deleted) != 1 || mock.deleted[0] != "42" {
+		t.Errorf("expected request 42 to be cancelled, got %v", mock.deleted)
+	}
+}
+
+// Tests the allowlist of hosts credentials may be sent to.
+func TestCheckAllowedHost(t *testing.T) {
+	const allowlist = "pwv.europe.intranet, pwv2.europe.intranet"
+
+	tests := []struct {
+		url       string
+		allowlist string
+		allowed   bool
+	}{
+		{"https://pwv.europe.intranet", allowlist, true},
+		{"https://PWV2.europe.intranet:8443/", allowlist, true},
+		{"https://pwv.europe.intranet.evil.com", allowlist, false},
+		{"https://evil.com/pwv.europe.intranet", allowlist, false},
+		{"https://user@evil.com", allowlist, false},
+		{"https://evil.com", "", true},
+	}
+
+	for _, test := range tests {
+		err := checkAllowedHost(test.url, test.allowlist)
+		if (err == nil) != test.allowed {
+			t.Errorf("%s: expected allowed %v, got error %v", test.url, test.allowed, err)
+		}
+	}
+}
+
+// Tests whether requests asking for too long access are left for manual
+// review.
+func TestApproveMaxGrant(t *testing.T) {
+	defer func() { *flagMaxGrant = 0 }()
+	*flagMaxGrant = 24 * time.Hour
+
+	requests := `
+		{"RequestID": "1", "RequestorUserName": "AB12CD", "AccessFrom": 1543388400, "AccessTo": 1543424400},
+		{"RequestID": "2", "RequestorUserName": "AB12CD", "AccessFrom": 1543388400, "AccessTo": 1543993200}`
+	api := newTestAPI(t, incomingRequestsHandler(requests))
+	out, _ := captureOutput(t)
+
+	if err := approveIncoming(api, "AB12CD", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"Confirming: AB12CD", "Manual review: AB12CD, request 2 asks for an access window of 168h0m0s", "Confirmed: 1, failed: 0, ignored: 1"} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("expected %q in output:\n%s", s, out)
+		}
+	}
+}
+
+// Tests whether the TLS handshake timeout applies, using a server which
+// accepts connections but never completes a handshake.
+func TestTransportTLSTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	tr := newTransport(transportOptions{DialTimeout: time.Second, TLSHandshakeTimeout: 50 * time.Millisecond})
+	client := http.Client{Transport: tr}
+
+	start := time.Now()
+	_, err = client.Get("https://" + l.Addr().String())
+	if err == nil || !strings.Contains(err.Error(), "TLS handshake timeout") {
+		t.Errorf("expected a TLS handshake timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the handshake to time out quickly, took %v", elapsed)
+	}
+}
+
+// guardedVault serves requests for two safes, of which only one matches the
+// safe guardrail used by the tests.
+func guardedVault() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/PasswordVault/API/IncomingRequests", incomingRequestsHandler(`
+		{"RequestID": "1", "RequestorUserName": "AB12CD", "AccountDetails": {"Properties": {"Name": "app", "Safe": "TEAM_APP"}}},
+		{"RequestID": "2", "RequestorUserName": "AB12CD", "AccountDetails": {"Properties": {"Name": "hr", "Safe": "HR_PAYROLL"}}}`))
+	mux.Handle("/PasswordVault/API/IncomingRequests/", incomingRequestsHandler(""))
+	mux.HandleFunc("/PasswordVault/API/MyRequests", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"MyRequests": [
+			{"RequestID": "3", "Status": 2, "AccountDetails": {"AccountID": "1_1", "Properties": {"Name": "app", "Safe": "TEAM_APP"}}},
+			{"RequestID": "4", "Status": 2, "AccountDetails": {"AccountID": "2_2", "Properties": {"Name": "hr", "Safe": "HR_PAYROLL"}}}
+		]}`)
+	})
+	mux.HandleFunc("/PasswordVault/WebServices/PIMServices.svc/Accounts/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "secret-"+strings.Split(r.URL.Path, "/")[5])
+	})
+	return mux
+}
+
+// Tests whether the safe guardrail applies to listing, approving and
+// retrieving alike.
+func TestSafeRegex(t *testing.T) {
+	safeRegex = regexp.MustCompile("^TEAM_")
+	defer func() { safeRegex = nil }()
+
+	api := newTestAPI(t, guardedVault())
+
+	out, _ := captureOutput(t)
+	listIncoming(api, allFilters(), listOptions{Format: "text"})
+	if !strings.Contains(out.String(), "'app'") || strings.Contains(out.String(), "'hr'") {
+		t.Errorf("expected only the TEAM_ safe to be listed, got:\n%s", out)
+	}
+
+	out, _ = captureOutput(t)
+	if err := approveIncoming(api, "AB12CD", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Confirmed: 1, failed: 0, ignored: 1") {
+		t.Errorf("expected only the TEAM_ safe to be approved, got:\n%s", out)
+	}
+
+	out, _ = captureOutput(t)
+	if err := retrieve(api, ""); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "app = secret-1_1\n" {
+		t.Errorf("expected only the TEAM_ safe to be retrieved, got:\n%s", out)
+	}
+}
+
+// Tests whether passwords which can't be retrieved are reported, without
+// holding back the others.
+func TestRetrieveErrors(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/PasswordVault/API/MyRequests", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"MyRequests": [
+			{"RequestID": "1", "AccountDetails": {"AccountID": "1_1", "Properties": {"Name": "app"}}},
+			{"RequestID": "2", "AccountDetails": {"AccountID": "2_2", "Properties": {"Name": "db"}}}
+		]}`)
+	})
+	mux.HandleFunc("/PasswordVault/WebServices/PIMServices.svc/Accounts/1_1/Credentials", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hunter2")
+	})
+	mux.HandleFunc("/PasswordVault/WebServices/PIMServices.svc/Accounts/2_2/Credentials", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"ErrorCode": "%s", "ErrorMessage": "Reason is required"}`, caErrReasonRequired)
+	})
+	api := newTestAPI(t, mux)
+	out, errOut := captureOutput(t)
+
+	err := retrieve(api, "")
+	if err == nil || !strings.Contains(err.Error(), "1 of 2") {
+		t.Errorf("expected an error about one password, got %v", err)
+	}
+	if out.String() != "app = hunter2\n" {
+		t.Errorf("expected the other password to be printed, got:\n%s", out)
+	}
+	if !strings.Contains(errOut.String(), "password of db") || !strings.Contains(errOut.String(), "-reason") {
+		t.Errorf("expected the account and the reason error on stderr, got:\n%s", errOut)
+	}
+}
+
+// Tests whether dumping fails on error responses, instead of writing them as
+// if they were data.
+func TestDumpErrors(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/PasswordVault/API/IncomingRequests", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"ErrorCode": "PASWS006E", "ErrorMessage": "Session expired"}`)
+	})
+	api := newTestAPI(t, mux)
+
+	var buf bytes.Buffer
+	if err := dump(api, &buf, false); err == nil || !strings.Contains(err.Error(), "PASWS006E") {
+		t.Errorf("expected the session error, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing to be dumped, got %s", buf.String())
+	}
+
+	mux = http.NewServeMux()
+	mux.HandleFunc("/PasswordVault/API/IncomingRequests", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"IncomingRequests": []}`)
+	})
+	mux.HandleFunc("/PasswordVault/API/MyRequests", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	api = newTestAPI(t, mux)
+
+	if err := dump(api, &buf, true); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("expected the status in the error, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing to be dumped, got %s", buf.String())
+	}
+}
+
+// Tests whether dumping writes the responses exactly as the vault sent them.
+func TestDump(t *testing.T) {
+	const incoming = `{"IncomingRequests": [ {"RequestID": "1", "Unmodelled": {"Nested": [1, 2.50, null]}} ],
+	"Total": 1}`
+	const mine = `{"MyRequests":[],"Extra":"kept as is"}`
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/PasswordVault/API/IncomingRequests", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, incoming)
+	})
+	mux.HandleFunc("/PasswordVault/API/MyRequests", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, mine)
+	})
+	api := newTestAPI(t, mux)
+
+	var buf bytes.Buffer
+	if err := dump(api, &buf, false); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != incoming {
+		t.Errorf("expected the response verbatim, got:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := dump(api, &buf, true); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"IncomingRequests":` + incoming + `,"MyRequests":` + mine + "}\n"; buf.String() != want {
+		t.Errorf("expected %q, got %q", want, buf.String())
+	}
+}
+
+// Tests whether the stats count the calls made to the vault.
+func TestStats(t *testing.T) {
+	var calls int
+	var mu sync.Mutex
+	handler := incomingRequestsHandler(mixedRequests, "2")
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	captureOutput(t)
+
+	if err := approveIncoming(api, "AB12CD,ef34gh", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := api.Stats()
+	if stats.Calls != calls || calls != 3 {
+		t.Errorf("expected 3 calls counted, got %d of %d made", stats.Calls, calls)
+	}
+	if stats.Operations["incoming-requests"] != 1 || stats.Operations["confirm"] != 2 {
+		t.Errorf("unexpected calls per operation: %v", stats.Operations)
+	}
+	if stats.Bytes == 0 {
+		t.Error("expected the response bytes to be counted")
+	}
+
+	var buf bytes.Buffer
+	writeStats(&buf, stats)
+	if !strings.HasPrefix(buf.String(), "API calls: 3, bytes: ") || !strings.Contains(buf.String(), "confirm            2\n") {
+		t.Errorf("unexpected stats output:\n%s", buf.String())
+	}
+}
+
+// Tests whether the partial state is reported when approving per requestor.
+func TestApproveAtomicPerUser(t *testing.T) {
+	api := newTestAPI(t, incomingRequestsHandler(`
+		{"RequestID": "1", "RequestorUserName": "ab12cd"},
+		{"RequestID": "2", "RequestorUserName": "AB12CD"},
+		{"RequestID": "3", "RequestorUserName": "EF34GH"}`, "2"))
+	out, errOut := captureOutput(t)
+
+	*flagAtomicPerUser = true
+	defer func() { *flagAtomicPerUser = false }()
+
+	if err := approveIncoming(api, "AB12CD,EF34GH", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), "Rolled back: AB12CD, request 1 ") {
+		t.Errorf("expected request 1 to be reported as rolled back, got:\n%s", out)
+	}
+	if !strings.HasSuffix(out.String(), "Confirmed: 1, failed: 1, rolled back: 1, ignored: 0\n") {
+		t.Errorf("unexpected summary:\n%s", out)
+	}
+	if !strings.Contains(errOut.String(), "Unable to confirm request 2") {
+		t.Errorf("expected the failure on stderr, got %q", errOut.String())
+	}
+}
+
+// Tests whether logging out is skipped with -no-logout.
+func TestNoLogout(t *testing.T) {
+	var logoffs int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/PasswordVault/WebServices/auth/Cyberark/CyberArkAuthenticationService.svc/Logoff", func(w http.ResponseWriter, r *http.Request) {
+		logoffs++
+	})
+	api := newTestAPI(t, mux)
+	_, errOut := captureOutput(t)
+
+	*flagNoLogout = true
+	logout(api)
+	*flagNoLogout = false
+	if logoffs != 0 {
+		t.Errorf("expected no logoff with -no-logout, got %d", logoffs)
+	}
+	if !strings.Contains(errOut.String(), "session stays valid") {
+		t.Errorf("expected a warning about the dangling session, got %q", errOut.String())
+	}
+
+	logout(api)
+	if logoffs != 1 {
+		t.Errorf("expected a logoff without -no-logout, got %d", logoffs)
+	}
+}
+
+// Tests whether listing stops at the limit, noting how many were left out.
+func TestListLimit(t *testing.T) {
+	api := newTestAPI(t, incomingRequestsHandler(mixedRequests))
+
+	for _, format := range []string{"text", "csv"} {
+		out, errOut := captureOutput(t)
+		listIncoming(api, allFilters(), listOptions{Format: format, Limit: 2})
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if want := map[string]int{"text": 2, "csv": 3}[format]; len(lines) != want {
+			t.Errorf("%s: expected %d lines, got:\n%s", format, want, out)
+		}
+		if strings.Contains(out.String(), "XX99XX") {
+			t.Errorf("%s: expected the last request to be left out, got:\n%s", format, out)
+		}
+		if errOut.String() != "Showing 2 of 3 requests, use -limit to show more.\n" {
+			t.Errorf("%s: unexpected truncation note %q", format, errOut.String())
+		}
+	}
+
+	out, errOut := captureOutput(t)
+	listIncoming(api, allFilters(), listOptions{Format: "text", Limit: 3})
+	if strings.Count(out.String(), "\n") != 3 || errOut.Len() != 0 {
+		t.Errorf("expected all requests without a note, got:\n%s%s", out, errOut)
+	}
+}
+
+// Tests whether listing reports how many requests were left out, and why.
+func TestListSkipReasons(t *testing.T) {
+	api := newTestAPI(t, incomingRequestsHandler(mixedRequests))
+	out, errOut := captureOutput(t)
+
+	listIncoming(api, requestorFilter("AB12CD", false), listOptions{Format: "text"})
+	if strings.Count(out.String(), "\n") != 1 {
+		t.Errorf("expected a single request, got:\n%s", out)
+	}
+	if got, want := errOut.String(), "Left out 2 requests: 2 user-not-allowed\n"; got != want {
+		t.Errorf("expected note %q, got %q", want, got)
+	}
+}
+
+// Tests whether approving stops at the first failure with -fail-fast.
+func TestApproveFailFast(t *testing.T) {
+	var confirms []string
+	handler := incomingRequestsHandler(mixedRequests, "1")
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/Confirm") {
+			confirms = append(confirms, r.URL.Path)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	api.FailFast = true
+	out, _ := captureOutput(t)
+
+	err := approveIncoming(api, "AB12CD,EF34GH,XX99XX", nil)
+	if err == nil || !strings.Contains(err.Error(), "request 1 failed to confirm") {
+		t.Errorf("expected the first failure to be returned, got %v", err)
+	}
+	if len(confirms) != 1 {
+		t.Errorf("expected a single confirmation attempt, got %v", confirms)
+	}
+	if !strings.Contains(out.String(), "Confirmed: 0, failed: 1, ignored: 0\n") {
+		t.Errorf("expected the handled request in the summary, got:\n%s", out)
+	}
+
+	api.FailFast = false
+	confirms = nil
+	captureOutput(t)
+	if err := approveIncoming(api, "AB12CD,EF34GH,XX99XX", nil); err != nil {
+		t.Errorf("expected to carry on without -fail-fast, got %v", err)
+	}
+	if len(confirms) != 3 {
+		t.Errorf("expected all requests to be confirmed, got %v", confirms)
+	}
+}
+
+// Tests whether only requests for accounts used before by the requestor are
+// approved with -require-prior-use.
+func TestApproveRequirePriorUse(t *testing.T) {
+	api := newTestAPI(t, incomingRequestsHandler(`
+		{"RequestID": "1", "RequestorUserName": "ab12cd", "AccountDetails": {"Properties": {"Name": "app", "LastUsedBy": "AB12CD"}}},
+		{"RequestID": "2", "RequestorUserName": "AB12CD", "AccountDetails": {"Properties": {"Name": "db", "LastUsedBy": "EF34GH"}}},
+		{"RequestID": "3", "RequestorUserName": "AB12CD", "AccountDetails": {"Properties": {"Name": "new"}}}`))
+	out, _ := captureOutput(t)
+
+	*flagPriorUse = true
+	defer func() { *flagPriorUse = false }()
+
+	if err := approveIncoming(api, "AB12CD", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Confirming: AB12CD, 'app'") || !strings.Contains(out.String(), "Confirmed: 1, failed: 0, ignored: 2 (2 no-prior-use)\n") {
+		t.Errorf("expected only the account used before to be approved, got:\n%s", out)
+	}
+}
+
+// Tests whether approving with -format json writes nothing but a single JSON
+// array of the results.
+func TestApproveJSONOutput(t *testing.T) {
+	api := newTestAPI(t, incomingRequestsHandler(mixedRequests, "2"))
+	out, _ := captureOutput(t)
+
+	*flagFormat = "json"
+	defer func() { *flagFormat = "text" }()
+
+	if err := approveIncoming(api, "AB12CD,ef34gh", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var results []map[string]string
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("expected a single JSON array, got %s:\n%s", err, out)
+	}
+	expected := []map[string]string{
+		{"request_id": "1", "requestor": "AB12CD", "account": "", "action": "confirm", "result": "confirmed"},
+		{"request_id": "2", "requestor": "EF34GH", "account": "", "action": "confirm", "result": "failed", "error": "PASWS001E (Nope)"},
+		{"request_id": "3", "requestor": "XX99XX", "account": "", "action": "ignore", "result": "ignored", "reason": "user-not-allowed"},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got:\n%s", len(expected), out)
+	}
+	for i := range expected {
+		if fmt.Sprint(results[i]) != fmt.Sprint(expected[i]) {
+			t.Errorf("expected %v, got %v", expected[i], results[i])
+		}
+	}
+}
+
+// Tests whether the connection file is written to the output file.
+func TestConnectOutput(t *testing.T) {
+	const rdp = "full address:s:10.0.0.1\r\n"
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `"`+base64.StdEncoding.EncodeToString([]byte(rdp))+`"`)
+	}))
+
+	*flagOutput = filepath.Join(t.TempDir(), "prod.rdp")
+	defer func() { *flagOutput = "" }()
+
+	w, err := createOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(api, w, "12_3", "PSM-RDP", ""); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	b, err := os.ReadFile(*flagOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != rdp {
+		t.Errorf("expected the RDP file, got %q", b)
+	}
+}
+
+// Tests whether a failing server info call is returned as an error.
+func TestServerInfoError(t *testing.T) {
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	out, _ := captureOutput(t)
+
+	if err := serverInfo(api); err == nil {
+		t.Errorf("expected an error")
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected nothing on stdout, got:\n%s", out)
+	}
+}
+
+// Tests whether a failing platforms call is returned as an error.
+func TestListPlatformsError(t *testing.T) {
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	captureOutput(t)
+
+	if err := listPlatforms(api, "text"); err == nil || !strings.Contains(err.Error(), "unable to get the platforms") {
+		t.Errorf("expected an error, got %v", err)
+	}
+}
+
+// Tests whether requestors differing in case only are told apart in the
+// output when case sensitive.
+func TestApproveCaseSensitiveRequestor(t *testing.T) {
+	api := newTestAPI(t, incomingRequestsHandler(`
+		{"RequestID": "1", "RequestorUserName": "ab12cd"},
+		{"RequestID": "2", "RequestorUserName": "AB12CD"}`))
+	out, _ := captureOutput(t)
+
+	*flagFormat, *flagCaseSensitive = "json", true
+	defer func() { *flagFormat, *flagCaseSensitive = "text", false }()
+
+	if err := approveIncoming(api, "ab12cd,AB12CD", nil); err != nil {
+		t.Fatal(err)
+	}
+	var results []approveResult
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("expected a single JSON array, got %s:\n%s", err, out)
+	}
+	if len(results) != 2 || results[0].Requestor != "ab12cd" || results[1].Requestor != "AB12CD" {
+		t.Errorf("expected the requestors as received, got %+v", results)
+	}
+}
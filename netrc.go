@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// netrcEntry is a machine entry from a netrc file.
+type netrcEntry struct {
+	Machine  string
+	Login    string
+	Password string
+}
+
+// parseNetrc parses a netrc file from r and returns the entry for the given
+// host. When no machine matches the host, the default entry is returned if
+// there is one. The boolean result reports whether an entry was found.
+func parseNetrc(r io.Reader, host string) (netrcEntry, bool, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanWords)
+
+	var tokens []string
+	for scanner.Scan() {
+		tokens = append(tokens, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return netrcEntry{}, false, err
+	}
+
+	var entries []netrcEntry
+	fallback := -1
+	for i := 0; i < len(tokens); i++ {
+		keyword := tokens[i]
+
+		// Keywords without a value.
+		switch keyword {
+		case "default":
+			entries = append(entries, netrcEntry{})
+			fallback = len(entries) - 1
+			continue
+		case "macdef":
+			// Macro definitions are not supported and end at an empty line,
+			// which is not visible when splitting by words. Stop here, since
+			// the remainder can't be trusted.
+			i = len(tokens)
+			continue
+		}
+
+		if i+1 >= len(tokens) {
+			return netrcEntry{}, false, fmt.Errorf("netrc: missing value for '%s'", keyword)
+		}
+		value := tokens[i+1]
+		i++
+
+		if keyword == "machine" {
+			entries = append(entries, netrcEntry{Machine: value})
+			continue
+		}
+		if len(entries) == 0 {
+			return netrcEntry{}, false, fmt.Errorf("netrc: '%s' found before any machine", keyword)
+		}
+
+		e := &entries[len(entries)-1]
+		switch keyword {
+		case "login":
+			e.Login = value
+		case "password":
+			e.Password = value
+		case "account", "port":
+			// Not used.
+		default:
+			return netrcEntry{}, false, fmt.Errorf("netrc: unknown keyword '%s'", keyword)
+		}
+	}
+
+	for _, e := range entries {
+		if e.Machine != "" && e.Machine == host {
+			return e, true, nil
+		}
+	}
+	if fallback >= 0 {
+		return entries[fallback], true, nil
+	}
+	return netrcEntry{}, false, nil
+}
+
+// readNetrc reads the netrc entry for the given host from the user's
+// ~/.netrc file. A missing file is not an error, and results in no entry
+// being found.
+func readNetrc(host string) (netrcEntry, bool, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return netrcEntry{}, false, err
+	}
+
+	f, err := os.Open(filepath.Join(home, ".netrc"))
+	if os.IsNotExist(err) {
+		return netrcEntry{}, false, nil
+	}
+	if err != nil {
+		return netrcEntry{}, false, err
+	}
+	defer f.Close()
+
+	return parseNetrc(f, host)
+}
+
+// mergeNetrc fills in the username and password from the netrc entry, without
+// overriding the values given as flags. The netrc password is only used when
+// the username is the login of the entry.
+func mergeNetrc(username, password string, e netrcEntry) (string, string) {
+	if username == "" {
+		username = e.Login
+	}
+	if password == "" && username == e.Login {
+		password = e.Password
+	}
+	return username, password
+}
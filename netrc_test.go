@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const sampleNetrc = `
+machine github.com login octocat password hunter2
+
+machine pwv.europe.intranet
+	login AB12CD
+	password s3cret
+	account ignored
+
+default login anonymous password guest
+`
+
+// Tests matching a machine in a netrc file.
+func TestParseNetrcMatch(t *testing.T) {
+	e, found, err := parseNetrc(strings.NewReader(sampleNetrc), "pwv.europe.intranet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("expected an entry to be found")
+	}
+	if e.Login != "AB12CD" || e.Password != "s3cret" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
+
+// Tests hosts not matching any machine, with and without default entry.
+func TestParseNetrcNoMatch(t *testing.T) {
+	e, found, err := parseNetrc(strings.NewReader(sampleNetrc), "pwv.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || e.Login != "anonymous" {
+		t.Errorf("expected the default entry, got %+v (%v)", e, found)
+	}
+
+	_, found, err = parseNetrc(strings.NewReader("machine github.com login octocat password hunter2"), "pwv.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("expected no entry to be found")
+	}
+}
+
+// Tests whether malformed netrc files result in an error.
+func TestParseNetrcMalformed(t *testing.T) {
+	for _, input := range []string{
+		"machine pwv.europe.intranet login",
+		"login AB12CD password s3cret",
+		"machine pwv.europe.intranet username AB12CD",
+	} {
+		if _, _, err := parseNetrc(strings.NewReader(input), "pwv.europe.intranet"); err == nil {
+			t.Errorf("expected an error for %q", input)
+		}
+	}
+}
+
+// Tests whether flags take precedence over the netrc entry.
+func TestMergeNetrc(t *testing.T) {
+	e := netrcEntry{Machine: "pwv.europe.intranet", Login: "AB12CD", Password: "s3cret"}
+
+	tests := []struct {
+		username, password string
+		expUser, expPass   string
+	}{
+		{"", "", "AB12CD", "s3cret"},
+		{"AB12CD", "", "AB12CD", "s3cret"},
+		{"AB12CD", "flagpass", "AB12CD", "flagpass"},
+		{"EF34GH", "", "EF34GH", ""},
+	}
+
+	for _, test := range tests {
+		u, p := mergeNetrc(test.username, test.password, e)
+		if u != test.expUser || p != test.expPass {
+			t.Errorf("%q/%q: expected %q/%q, got %q/%q", test.username, test.password, test.expUser, test.expPass, u, p)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// formats are the supported output formats.
+var formats = []string{"text", "csv", "json"}
+
+// validFormat returns whether format is one of the supported output formats.
+func validFormat(format string) bool {
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// listOptions control how listed items are written.
+type listOptions struct {
+	Format      string             // One of the formats.
+	Template    *template.Template // Used instead of the default text format, if set.
+	ShowContact bool               // Whether to include the requestor's contact details.
+	Limit       int                // Maximum number of requests to write, 0 for all.
+	MaskNames   bool               // Whether to partially hide account names and addresses.
+}
+
+// templateFuncs are the additional functions available to -template.
+var templateFuncs = template.FuncMap{
+	// date formats a timestamp using the given Go time layout.
+	"date": func(layout string, t caTime) string {
+		return t.Format(layout)
+	},
+}
+
+// parseTemplate parses the user supplied template, which is executed once
+// for every item that is listed.
+func parseTemplate(text string) (*template.Template, error) {
+	return template.New("list").Funcs(templateFuncs).Parse(text)
+}
+
+// requestorContact returns the display name and email address of the
+// requestor, such as "John Doe <john@example.com>". Details which are not
+// known are left out, resulting in an empty string if none are.
+func requestorContact(r caIncomingRequest) string {
+	switch {
+	case r.RequestorFullName != "" && r.RequestorEmail != "":
+		return fmt.Sprintf("%s <%s>", r.RequestorFullName, r.RequestorEmail)
+	case r.RequestorEmail != "":
+		return "<" + r.RequestorEmail + ">"
+	}
+	return r.RequestorFullName
+}
+
+// writeIncoming writes a single incoming request to w. When no template is
+// given, the default format is used, otherwise the output of the template.
+func writeIncoming(w io.Writer, r caIncomingRequest, opts listOptions) error {
+	if opts.Template == nil {
+		requestor := r.RequestorUserName
+		if contact := requestorContact(r); opts.ShowContact && contact != "" {
+			requestor += " (" + contact + ")"
+		}
+		_, err := fmt.Fprintf(w, "Incoming: %s, '%s' ('%s')\n",
+			requestor,
+			r.AccountDetails.Properties.Name,
+			r.UserReason)
+		return err
+	}
+
+	if err := opts.Template.Execute(w, r); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// writeIncomingList writes the incoming requests to w, in the given format.
+// The template is only used for the text format.
+func writeIncomingList(w io.Writer, requests []caIncomingRequest, opts listOptions) error {
+	if opts.MaskNames {
+		masked := make([]caIncomingRequest, len(requests))
+		for i, r := range requests {
+			r.AccountDetails.Properties.Name = maskMiddle(r.AccountDetails.Properties.Name)
+			r.AccountDetails.Properties.Address = maskMiddle(r.AccountDetails.Properties.Address)
+			masked[i] = r
+		}
+		requests = masked
+	}
+
+	switch opts.Format {
+	case "text":
+		for _, r := range requests {
+			if err := writeIncoming(w, r, opts); err != nil {
+				return fmt.Errorf("request %s: %s", r.RequestID, err)
+			}
+		}
+		return nil
+	case "csv":
+		return writeIncomingCSV(w, requests)
+	case "json":
+		if requests == nil {
+			requests = []caIncomingRequest{}
+		}
+		return writeJSON(w, requests)
+	}
+	return fmt.Errorf("unknown format '%s'", opts.Format)
+}
+
+// maskMiddle hides all but the first and last two characters of s, keeping
+// its length. Strings too short to hide anything that way are hidden
+// completely.
+func maskMiddle(s string) string {
+	runes := []rune(s)
+	if len(runes) <= 4 {
+		return strings.Repeat("*", len(runes))
+	}
+	return string(runes[:2]) + strings.Repeat("*", len(runes)-4) + string(runes[len(runes)-2:])
+}
+
+// writeIncomingCSV writes the incoming requests as CSV to w, starting with a
+// header row. Times are formatted as RFC3339.
+func writeIncomingCSV(w io.Writer, requests []caIncomingRequest) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"RequestID", "Requestor", "Safe", "Account", "Address", "Reason", "AccessFrom", "AccessTo"})
+	for _, r := range requests {
+		cw.Write([]string{
+			r.RequestID,
+			r.RequestorUserName,
+			r.AccountDetails.Properties.Safe,
+			r.AccountDetails.Properties.Name,
+			r.AccountDetails.Properties.Address,
+			r.UserReason,
+			r.AccessFrom.Format(time.RFC3339),
+			r.AccessTo.Format(time.RFC3339),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writePlatforms writes the platforms to w, in the given format.
+func writePlatforms(w io.Writer, platforms []caPlatform, format string) error {
+	switch format {
+	case "text":
+		for _, p := range platforms {
+			state := ""
+			if !p.Active {
+				state = " (inactive)"
+			}
+			if _, err := fmt.Fprintf(w, "%s: %s%s\n", p.ID, p.Name, state); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"ID", "Name", "SystemType", "Active"})
+		for _, p := range platforms {
+			cw.Write([]string{p.ID, p.Name, p.SystemType, strconv.FormatBool(p.Active)})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "json":
+		return writeJSON(w, platforms)
+	}
+	return fmt.Errorf("unknown format '%s'", format)
+}
+
+// approveResult is the outcome of a request handled by the approve operation,
+// as written with -format json.
+type approveResult struct {
+	RequestID string `json:"request_id"`
+	Requestor string `json:"requestor"`
+	Account   string `json:"account"`
+	Action    string `json:"action"` // Either "confirm", "rollback" or "ignore".
+	Result    string `json:"result"`
+	Error     string `json:"error,omitempty"`
+	Reason    string `json:"reason,omitempty"` // Why the request was ignored.
+}
+
+// writeApproveResults writes the results as a single JSON array.
+func writeApproveResults(w io.Writer, results []approveResult) error {
+	if results == nil {
+		results = []approveResult{}
+	}
+	return writeJSON(w, results)
+}
+
+// writeJSON writes v as indented JSON to w.
+func writeJSON(w io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// writeStats writes a summary of the API calls made, with the number of calls
+// per operation sorted by name.
+func writeStats(w io.Writer, stats caStats) {
+	fmt.Fprintf(w, "API calls: %d, bytes: %d, time: %s\n", stats.Calls, stats.Bytes, stats.Duration.Round(time.Millisecond))
+
+	ops := make([]string, 0, len(stats.Operations))
+	for op := range stats.Operations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		fmt.Fprintf(w, "  %-18s %d\n", op, stats.Operations[op])
+	}
+}
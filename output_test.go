@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests rendering a user supplied template over multiple requests.
+func TestWriteIncomingTemplate(t *testing.T) {
+	tmpl, err := parseTemplate(`{{.RequestID}} {{.RequestorUserName}} {{.AccountDetails.Properties.Safe}} {{.AccessFrom}} {{date "2006-01-02" .AccessTo}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := make([]caIncomingRequest, 2)
+	requests[0].RequestID = "1"
+	requests[0].RequestorUserName = "AB12CD"
+	requests[0].AccountDetails.Properties.Safe = "SAFE1"
+	requests[0].AccessFrom.Time = time.Date(2018, 11, 28, 7, 0, 0, 0, time.UTC)
+	requests[0].AccessTo.Time = time.Date(2018, 11, 30, 18, 0, 0, 0, time.UTC)
+	requests[1].RequestID = "2"
+	requests[1].RequestorUserName = "EF34GH"
+	requests[1].AccountDetails.Properties.Safe = "SAFE2"
+	requests[1].AccessFrom.Time = time.Date(2018, 12, 1, 7, 0, 0, 0, time.UTC)
+	requests[1].AccessTo.Time = time.Date(2018, 12, 2, 18, 0, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	for _, r := range requests {
+		if err := writeIncoming(&buf, r, listOptions{Format: "text", Template: tmpl}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := "1 AB12CD SAFE1 2018-11-28T07:00:00Z 2018-11-30\n" +
+		"2 EF34GH SAFE2 2018-12-01T07:00:00Z 2018-12-02\n"
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+// Tests whether invalid templates are rejected up front.
+func TestParseTemplateInvalid(t *testing.T) {
+	if _, err := parseTemplate("{{.RequestID"); err == nil {
+		t.Error("expected an error for an unterminated action")
+	}
+}
+
+// Tests the default format when no template is given.
+func TestWriteIncomingDefault(t *testing.T) {
+	r := caIncomingRequest{RequestorUserName: "AB12CD", UserReason: "because"}
+	r.AccountDetails.Properties.Name = "Administrator"
+
+	var buf bytes.Buffer
+	if err := writeIncoming(&buf, r, listOptions{Format: "text"}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "Incoming: AB12CD, 'Administrator' ('because')\n"; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+// Tests the CSV header and a sample row.
+func TestWriteIncomingCSV(t *testing.T) {
+	r := caIncomingRequest{
+		RequestID:         "01451_ZKV-M-DTA-O_2224",
+		RequestorUserName: "JA43OP",
+		UserReason:        "for rcic, urgently",
+	}
+	r.AccountDetails.Properties.Safe = "01451_ZKV-M-DTA-O"
+	r.AccountDetails.Properties.Name = "Administrator@zkv-ACCP"
+	r.AccountDetails.Properties.Address = "accp.cds.intranet"
+	r.AccessFrom.Time = time.Unix(1543388400, 0).UTC()
+	r.AccessTo.Time = time.Unix(1543600800, 0).UTC()
+
+	var buf bytes.Buffer
+	if err := writeIncomingList(&buf, []caIncomingRequest{r}, listOptions{Format: "csv"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "RequestID,Requestor,Safe,Account,Address,Reason,AccessFrom,AccessTo\n" +
+		"01451_ZKV-M-DTA-O_2224,JA43OP,01451_ZKV-M-DTA-O,Administrator@zkv-ACCP,accp.cds.intranet,\"for rcic, urgently\",2018-11-28T07:00:00Z,2018-11-30T18:00:00Z\n"
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+// Tests which output formats are accepted.
+func TestValidFormat(t *testing.T) {
+	if !validFormat("text") || !validFormat("csv") {
+		t.Error("expected text and csv to be valid formats")
+	}
+	if validFormat("xml") {
+		t.Error("expected xml to be an invalid format")
+	}
+}
+
+// Tests decoding and showing the contact details of the requestor.
+func TestWriteIncomingContact(t *testing.T) {
+	resp := caIncomingRequestsResponse{}
+	err := json.Unmarshal([]byte(`{"IncomingRequests": [
+		{"RequestorUserName": "AB12CD", "RequestorFullName": "John Doe", "RequestorEmail": "john.doe@example.com", "UserReason": "because"},
+		{"RequestorUserName": "EF34GH", "RequestorFullName": "Jane Doe", "UserReason": "why not"},
+		{"RequestorUserName": "IJ56KL", "RequestorEmail": "nobody@example.com", "UserReason": "hmm"},
+		{"RequestorUserName": "XX99XX", "UserReason": "let me in"}
+	]}`), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeIncomingList(&buf, resp.IncomingRequests, listOptions{Format: "text", ShowContact: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "Incoming: AB12CD (John Doe <john.doe@example.com>), '' ('because')\n" +
+		"Incoming: EF34GH (Jane Doe), '' ('why not')\n" +
+		"Incoming: IJ56KL (<nobody@example.com>), '' ('hmm')\n" +
+		"Incoming: XX99XX, '' ('let me in')\n"
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	buf.Reset()
+	writeIncoming(&buf, resp.IncomingRequests[0], listOptions{Format: "text"})
+	if strings.Contains(buf.String(), "John Doe") {
+		t.Errorf("expected no contact details without -show-requestor, got %q", buf.String())
+	}
+}
+
+// Tests writing platforms in the text and CSV formats.
+func TestWritePlatforms(t *testing.T) {
+	platforms := []caPlatform{
+		{ID: "WinDomain", Name: "Windows Domain Account", SystemType: "Windows", Active: true},
+		{ID: "UnixSSH", Name: "Unix via SSH", SystemType: "*NIX"},
+	}
+
+	var buf bytes.Buffer
+	if err := writePlatforms(&buf, platforms, "text"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "WinDomain: Windows Domain Account\nUnixSSH: Unix via SSH (inactive)\n"; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+
+	buf.Reset()
+	if err := writePlatforms(&buf, platforms, "csv"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "ID,Name,SystemType,Active\nWinDomain,Windows Domain Account,Windows,true\nUnixSSH,Unix via SSH,*NIX,false\n"; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+// Tests masking short and long names.
+func TestMaskMiddle(t *testing.T) {
+	tests := map[string]string{
+		"":                       "",
+		"a":                      "*",
+		"root":                   "****",
+		"admin":                  "ad*in",
+		"Administrator@zkv-ACCP": "Ad******************CP",
+		"accp.cds.intranet":      "ac*************et",
+		"bébé-à-la-mer":          "bé*********er",
+	}
+	for input, expected := range tests {
+		if got := maskMiddle(input); got != expected {
+			t.Errorf("%q: expected %q, got %q", input, expected, got)
+		}
+	}
+}
+
+// Tests whether names and addresses are masked in every format.
+func TestWriteIncomingMasked(t *testing.T) {
+	r := caIncomingRequest{RequestID: "1", RequestorUserName: "AB12CD", UserReason: "because"}
+	r.AccountDetails.Properties.Name = "Administrator"
+	r.AccountDetails.Properties.Address = "prod.example.com"
+
+	var buf bytes.Buffer
+	if err := writeIncomingList(&buf, []caIncomingRequest{r}, listOptions{Format: "text", MaskNames: true}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "Incoming: AB12CD, 'Ad*********or' ('because')\n"; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+
+	buf.Reset()
+	if err := writeIncomingList(&buf, []caIncomingRequest{r}, listOptions{Format: "csv", MaskNames: true}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "Administrator") || !strings.Contains(buf.String(), ",Ad*********or,pr************om,") {
+		t.Errorf("expected masked names in the CSV, got:\n%s", buf.String())
+	}
+	if r.AccountDetails.Properties.Name != "Administrator" {
+		t.Error("expected the request itself to be left alone")
+	}
+}
+
+// Tests whether listing as JSON writes an array, also when empty.
+func TestWriteIncomingJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeIncomingList(&buf, nil, listOptions{Format: "json"}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "[]\n" {
+		t.Errorf("expected an empty array, got %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := writeIncomingList(&buf, []caIncomingRequest{{RequestID: "1", UserReason: "because"}}, listOptions{Format: "json"}); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []caIncomingRequest
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 1 || decoded[0].RequestID != "1" || decoded[0].UserReason != "because" {
+		t.Errorf("unexpected JSON:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// errNoPinentry is returned when the pinentry program can't be started, in
+// which case the password is better asked for on the terminal.
+var errNoPinentry = errors.New("pinentry is not available")
+
+// pinentry asks for a password using the pinentry program at path, such as
+// the one shipped with GnuPG, showing the given description and prompt.
+func pinentry(path, description, prompt string) (string, error) {
+	cmd := exec.Command(path)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("%w: %s", errNoPinentry, err)
+	}
+
+	pin, err := pinentryConverse(bufio.NewReader(out), in, description, prompt)
+	in.Close()
+	if werr := cmd.Wait(); err == nil && werr != nil {
+		err = werr
+	}
+	return pin, err
+}
+
+// pinentryConverse talks the Assuan protocol of pinentry: after the greeting,
+// the description and prompt are set and the PIN is requested.
+func pinentryConverse(r *bufio.Reader, w io.Writer, description, prompt string) (string, error) {
+	if _, err := readPinentryResponse(r); err != nil {
+		return "", err
+	}
+
+	commands := []string{
+		"SETDESC " + pinentryEscape(description),
+		"SETPROMPT " + pinentryEscape(prompt),
+	}
+	for _, c := range commands {
+		if _, err := fmt.Fprintf(w, "%s\n", c); err != nil {
+			return "", err
+		}
+		if _, err := readPinentryResponse(r); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := fmt.Fprintf(w, "GETPIN\n"); err != nil {
+		return "", err
+	}
+	pin, err := readPinentryResponse(r)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprintf(w, "BYE\n")
+	return pin, nil
+}
+
+// readPinentryResponse reads the lines of a single response, up to the
+// closing OK or ERR line, and returns the decoded data lines.
+func readPinentryResponse(r *bufio.Reader) (string, error) {
+	var data strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return "", fmt.Errorf("pinentry closed the connection")
+			}
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data.String(), nil
+		case strings.HasPrefix(line, "ERR "):
+			return "", fmt.Errorf("pinentry: %s", strings.TrimPrefix(line, "ERR "))
+		case strings.HasPrefix(line, "D "):
+			d, err := pinentryUnescape(strings.TrimPrefix(line, "D "))
+			if err != nil {
+				return "", err
+			}
+			data.WriteString(d)
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "S "):
+			// Comments and status lines carry nothing of interest.
+		default:
+			return "", fmt.Errorf("unexpected response from pinentry: %q", line)
+		}
+	}
+}
+
+// pinentryEscape percent-encodes the characters which can't be sent as is.
+func pinentryEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// pinentryUnescape decodes the percent-encoded characters in a data line.
+func pinentryUnescape(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("invalid escape in pinentry data: %q", s[i:])
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in pinentry data: %q", s[i:i+3])
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
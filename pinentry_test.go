@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Tests parsing the responses of pinentry.
+func TestReadPinentryResponse(t *testing.T) {
+	tests := []struct {
+		input string
+		data  string
+		err   bool
+	}{
+		{"OK Pleased to meet you\n", "", false},
+		{"OK\n", "", false},
+		{"D s3cr%25t\nOK\n", "s3cr%t", false},
+		{"# comment\nS PASSWORD_FROM_CACHE\nD a%0Ab\nOK\n", "a\nb", false},
+		{"D part1\nD part2\nOK\n", "part1part2", false},
+		{"ERR 83886179 Operation cancelled <Pinentry>\n", "", true},
+		{"D broken%2\nOK\n", "", true},
+		{"INQUIRE SOMETHING\n", "", true},
+		{"D no end\n", "", true},
+	}
+
+	for _, test := range tests {
+		data, err := readPinentryResponse(bufio.NewReader(strings.NewReader(test.input)))
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error: %v", test.input, err)
+		}
+		if data != test.data {
+			t.Errorf("%q: expected %q, got %q", test.input, test.data, data)
+		}
+	}
+}
+
+// Tests the commands sent to pinentry, and whether special characters are
+// escaped.
+func TestPinentryConverse(t *testing.T) {
+	responses := "OK Pleased to meet you\nOK\nOK\nD p%25ss\nOK\n"
+	var sent strings.Builder
+
+	pin, err := pinentryConverse(bufio.NewReader(strings.NewReader(responses)), &sent, "Password of\nAB12CD", "100%:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pin != "p%ss" {
+		t.Errorf("expected pin %q, got %q", "p%ss", pin)
+	}
+	if want := "SETDESC Password of%0AAB12CD\nSETPROMPT 100%25:\nGETPIN\nBYE\n"; sent.String() != want {
+		t.Errorf("expected commands %q, got %q", want, sent.String())
+	}
+}
+
+// Tests running a stub pinentry program, and cancelling it.
+func TestPinentry(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no shell to run the stub pinentry with")
+	}
+
+	stub := func(pin string) string {
+		path := filepath.Join(t.TempDir(), "pinentry")
+		script := "#!/bin/sh\necho 'OK Pleased to meet you'\n" +
+			"while read cmd args; do\n" +
+			"  case $cmd in\n" +
+			"    GETPIN) " + pin + " ;;\n" +
+			"    BYE) echo OK; exit 0 ;;\n" +
+			"    *) echo OK ;;\n" +
+			"  esac\n" +
+			"done\n"
+		if err := os.WriteFile(path, []byte(script), 0700); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	pin, err := pinentry(stub("echo 'D hunter2'; echo OK"), "desc", "Password:")
+	if err != nil || pin != "hunter2" {
+		t.Errorf("expected pin hunter2, got %q (%v)", pin, err)
+	}
+
+	_, err = pinentry(stub("echo 'ERR 83886179 Operation cancelled'"), "desc", "Password:")
+	if err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Errorf("expected a cancellation error, got %v", err)
+	}
+
+	_, err = pinentry(filepath.Join(t.TempDir(), "missing"), "desc", "Password:")
+	if !errors.Is(err, errNoPinentry) {
+		t.Errorf("expected pinentry to be unavailable, got %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// redacted replaces credentials in recorded requests and responses.
+const redacted = "[redacted]"
+
+// redactedHeaders are the headers which may carry credentials.
+var redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+// redactedFields are the JSON fields which may carry credentials, such as the
+// password when logging in and the logon key returned. They're matched
+// case-insensitively.
+var redactedFields = []string{"password", "newPassword", "CyberArkLogonResult"}
+
+// secretPaths are the suffixes of the paths which return a password as the
+// whole response body.
+var secretPaths = []string{"/Credentials", "/Password/Retrieve"}
+
+// recording is a single request and response pair, as saved to a file.
+type recording struct {
+	Method         string      `json:"method"`
+	URL            string      `json:"url"` // Only the path and query, so the host doesn't matter.
+	RequestHeader  http.Header `json:"request_header,omitempty"`
+	RequestBody    string      `json:"request_body,omitempty"`
+	Status         int         `json:"status"`
+	ResponseHeader http.Header `json:"response_header,omitempty"`
+	ResponseBody   string      `json:"response_body,omitempty"`
+}
+
+// recorder is an http.RoundTripper which saves every request and response to
+// a numbered file in a directory, with the credentials redacted, to be served
+// by a replayer later on.
+type recorder struct {
+	next   http.RoundTripper
+	dir    string
+	redact []string // Headers redacted on top of redactedHeaders.
+
+	mu sync.Mutex
+	n  int // The number of recordings saved. Guarded by mu.
+}
+
+// newRecorder creates a recorder saving to dir, which is created when it
+// doesn't exist yet. The requests themselves are sent using next. The headers
+// given with -header may carry credentials too, so their names should be
+// passed as redact.
+func newRecorder(next http.RoundTripper, dir string, redact []string) (*recorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	existing, err := recordingFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		return nil, fmt.Errorf("directory '%s' already contains a recorded session", dir)
+	}
+	return &recorder{next: next, dir: dir, redact: redact}, nil
+}
+
+func (rec *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		reqBody = b
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+		// The body may contain the password, of which the recording only
+		// keeps a redacted copy. The caller wipes its own copy.
+		defer wipe(reqBody)
+	}
+	r := recording{
+		Method:        req.Method,
+		URL:           req.URL.RequestURI(),
+		RequestHeader: redactHeader(req.Header, rec.redact),
+		RequestBody:   redactBody(reqBody),
+	}
+
+	resp, err := rec.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	r.Status = resp.StatusCode
+	r.ResponseHeader = redactHeader(resp.Header, rec.redact)
+	if resp.StatusCode/100 == 2 && hasSuffix(req.URL.Path, secretPaths) {
+		r.ResponseBody = redactSecretBody(body)
+	} else {
+		r.ResponseBody = redactBody(body)
+	}
+
+	if err := rec.save(r); err != nil {
+		return nil, fmt.Errorf("unable to record %s %s: %s", req.Method, r.URL, err)
+	}
+	return resp, nil
+}
+
+// save writes the recording to the next numbered file.
+func (rec *recorder) save(r recording) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.n++
+	return ioutil.WriteFile(filepath.Join(rec.dir, fmt.Sprintf("%04d.json", rec.n)), append(b, '\n'), 0600)
+}
+
+// replayer is an http.RoundTripper which serves the responses saved by a
+// recorder, in the same order, without touching the network. Every request
+// must match the recorded one.
+type replayer struct {
+	mu         sync.Mutex
+	recordings []recording // Guarded by mu.
+	n          int         // The number of responses served. Guarded by mu.
+}
+
+// newReplayer loads the session recorded in dir.
+func newReplayer(dir string) (*replayer, error) {
+	files, err := recordingFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("directory '%s' contains no recorded session", dir)
+	}
+
+	rep := &replayer{}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var r recording
+		if err := json.Unmarshal(b, &r); err != nil {
+			return nil, fmt.Errorf("unable to read recording '%s': %s", f, err)
+		}
+		rep.recordings = append(rep.recordings, r)
+	}
+	return rep, nil
+}
+
+func (rep *replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	if rep.n >= len(rep.recordings) {
+		return nil, fmt.Errorf("no recorded response left for %s %s, only %d were recorded", req.Method, req.URL.RequestURI(), len(rep.recordings))
+	}
+	r := rep.recordings[rep.n]
+	if r.Method != req.Method || r.URL != req.URL.RequestURI() {
+		return nil, fmt.Errorf("request %d is %s %s, but %s %s was recorded", rep.n+1, req.Method, req.URL.RequestURI(), r.Method, r.URL)
+	}
+	rep.n++
+
+	header := r.ResponseHeader
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status)),
+		StatusCode:    r.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(r.ResponseBody)),
+		ContentLength: int64(len(r.ResponseBody)),
+		Request:       req,
+	}, nil
+}
+
+// recordingFiles returns the recordings in dir, in the order they were made.
+func recordingFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "[0-9][0-9][0-9][0-9].json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// redactHeader returns a copy of h with the credentials redacted, including
+// the extra headers given.
+func redactHeader(h http.Header, extra []string) http.Header {
+	if len(h) == 0 {
+		return nil
+	}
+	c := h.Clone()
+	for _, name := range append(append([]string{}, redactedHeaders...), extra...) {
+		name = http.CanonicalHeaderKey(name)
+		if _, ok := c[name]; ok {
+			c[name] = []string{redacted}
+		}
+	}
+	return c
+}
+
+// redactBody returns the body with the credentials redacted from JSON
+// objects. Anything else is returned as is.
+func redactBody(body []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return string(body)
+	}
+	if !redactValue(v) {
+		return string(body)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return redacted
+	}
+	return string(b)
+}
+
+// redactValue redacts the credentials in v, as decoded by encoding/json, and
+// returns whether there were any.
+func redactValue(v interface{}) bool {
+	found := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if isRedactedField(key) {
+				v[key] = redacted
+				found = true
+			} else if redactValue(value) {
+				found = true
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			if redactValue(value) {
+				found = true
+			}
+		}
+	}
+	return found
+}
+
+// isRedactedField returns whether the JSON field may carry a credential.
+func isRedactedField(key string) bool {
+	for _, f := range redactedFields {
+		if strings.EqualFold(key, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactSecretBody redacts a body consisting of just a password, keeping it
+// a JSON string when it was one.
+func redactSecretBody(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte(`"`)) {
+		return `"` + redacted + `"`
+	}
+	return redacted
+}
+
+// hasSuffix returns whether s ends with any of the suffixes.
+func hasSuffix(s string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
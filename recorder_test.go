@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// recordedVault serves a vault with a password, which must never end up in a
+// recording.
+func recordedVault() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/PasswordVault/WebServices/auth/Cyberark/CyberArkAuthenticationService.svc/Logon", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"CyberArkLogonResult": "logon-key-123"}`)
+	})
+	mux.HandleFunc("/PasswordVault/WebServices/auth/Cyberark/CyberArkAuthenticationService.svc/Logoff", func(w http.ResponseWriter, r *http.Request) {})
+	mux.Handle("/PasswordVault/API/IncomingRequests", incomingRequestsHandler(mixedRequests))
+	mux.HandleFunc("/PasswordVault/API/Accounts/12_3/Password/Retrieve", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=cookie-456")
+		fmt.Fprint(w, `"hunter2"`)
+	})
+	return mux
+}
+
+// recordedSession logs in, lists the incoming requests, retrieves a password
+// and logs out, returning everything the session printed.
+func recordedSession(t *testing.T, api *caAPI) string {
+	out, errOut := captureOutput(t)
+
+	if err := api.Login("AB12CD", newSecret([]byte("s3cret"))); err != nil {
+		t.Fatal(err)
+	}
+	listIncoming(api, allFilters(), listOptions{Format: "text"})
+	password, _, err := api.RetrievePassword("12_3", "testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	printSecret(out, "Password: ", password)
+	if err := api.Logout(); err != nil {
+		t.Fatal(err)
+	}
+	return out.String() + errOut.String()
+}
+
+// Tests whether a recorded session replays the same without the vault, while
+// no credentials are recorded.
+func TestRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewServer(recordedVault())
+	defer server.Close()
+
+	headers := http.Header{"X-Api-Key": {"gateway-secret"}}
+	rec, err := newRecorder(server.Client().Transport, dir, []string{"X-Api-Key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &caAPI{Base: server.URL, Client: http.Client{Transport: rec}, Headers: headers}
+	recorded := recordedSession(t, api)
+	if !strings.Contains(recorded, "Password: hunter2") {
+		t.Fatalf("expected the password to be retrieved, got:\n%s", recorded)
+	}
+
+	files, err := recordingFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Fatalf("expected 4 recordings, got %v", files)
+	}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, credential := range []string{"s3cret", "logon-key-123", "hunter2", "cookie-456", "gateway-secret"} {
+			if strings.Contains(string(b), credential) {
+				t.Errorf("expected %s to be redacted from %s, got:\n%s", credential, filepath.Base(f), b)
+			}
+		}
+	}
+
+	// Every replay gives the same output, except for the redacted password.
+	want := strings.Replace(recorded, "hunter2", redacted, 1)
+	for i := 0; i < 2; i++ {
+		rep, err := newReplayer(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		api := &caAPI{Base: "http://vault.invalid", Client: http.Client{Transport: rep}}
+		if got := recordedSession(t, api); got != want {
+			t.Errorf("replay %d: expected:\n%s\ngot:\n%s", i+1, want, got)
+		}
+	}
+}
+
+// Tests whether replaying fails on requests which weren't recorded.
+func TestReplayMismatch(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewServer(recordedVault())
+	defer server.Close()
+
+	rec, err := newRecorder(server.Client().Transport, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &caAPI{Base: server.URL, Client: http.Client{Transport: rec}, LogonKey: "test-logon-key"}
+	if _, err := api.IncomingRequests(); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := newReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api = &caAPI{Base: "http://vault.invalid", Client: http.Client{Transport: rep}, LogonKey: "test-logon-key"}
+	if _, _, err := api.RetrievePassword("12_3", "testing"); err == nil || !strings.Contains(err.Error(), "was recorded") {
+		t.Errorf("expected a mismatch with the recording, got %v", err)
+	}
+	if _, err := api.IncomingRequests(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.IncomingRequests(); err == nil || !strings.Contains(err.Error(), "no recorded response left") {
+		t.Errorf("expected the recording to be used up, got %v", err)
+	}
+
+	if _, err := newRecorder(server.Client().Transport, dir, nil); err == nil {
+		t.Errorf("expected recording over an existing session to fail")
+	}
+	if _, err := newReplayer(t.TempDir()); err == nil {
+		t.Errorf("expected replaying an empty directory to fail")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// secret holds a credential, such as a password, in a byte slice instead of
+// a string, so it can be wiped from memory as soon as it's been used. It never
+// prints its contents by accident.
+type secret struct {
+	b []byte
+}
+
+// newSecret creates a secret owning b. The caller shouldn't use b afterwards.
+func newSecret(b []byte) *secret {
+	return &secret{b: b}
+}
+
+// Bytes returns the contents of the secret. It's only valid until Destroy is
+// called.
+func (s *secret) Bytes() []byte {
+	if s == nil {
+		return nil
+	}
+	return s.b
+}
+
+// Empty returns whether the secret has no contents.
+func (s *secret) Empty() bool {
+	return s == nil || len(s.b) == 0
+}
+
+// Destroy zeroes the contents of the secret, leaving it empty.
+func (s *secret) Destroy() {
+	if s == nil {
+		return
+	}
+	wipe(s.b)
+	s.b = nil
+}
+
+// String hides the contents, so a secret can't end up in output or logs.
+func (s *secret) String() string {
+	return "[redacted]"
+}
+
+// GoString hides the contents for %#v as well.
+func (s *secret) GoString() string {
+	return s.String()
+}
+
+// appendJSON appends the secret as a JSON string to dst, without converting
+// it to a Go string first. To prevent copies from being left behind, dst must
+// have room for maxJSONLen more bytes.
+func (s *secret) appendJSON(dst []byte) ([]byte, error) {
+	const hex = "0123456789abcdef"
+
+	b := s.Bytes()
+	if !utf8.Valid(b) {
+		return nil, fmt.Errorf("secret is not valid UTF-8")
+	}
+	dst = append(dst, '"')
+	for _, c := range b {
+		switch {
+		case c == '"' || c == '\\':
+			dst = append(dst, '\\', c)
+		case c < 0x20:
+			dst = append(dst, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return append(dst, '"'), nil
+}
+
+// maxJSONLen returns the most bytes appendJSON may append.
+func (s *secret) maxJSONLen() int {
+	return 6*len(s.Bytes()) + 2
+}
+
+// wipe zeroes b.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
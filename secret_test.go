@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// Tests whether destroying a secret zeroes its buffer.
+func TestSecretDestroy(t *testing.T) {
+	buf := []byte("hunter2")
+	s := newSecret(buf)
+	if string(s.Bytes()) != "hunter2" || s.Empty() {
+		t.Fatalf("expected the contents, got %q", s.Bytes())
+	}
+
+	s.Destroy()
+	if !bytes.Equal(buf, make([]byte, len(buf))) {
+		t.Errorf("expected the buffer to be zeroed, got %q", buf)
+	}
+	if !s.Empty() || s.Bytes() != nil {
+		t.Errorf("expected the secret to be empty, got %q", s.Bytes())
+	}
+
+	var none *secret
+	none.Destroy()
+	if !none.Empty() {
+		t.Error("expected a nil secret to be empty")
+	}
+}
+
+// Tests whether formatting a secret never shows its contents.
+func TestSecretString(t *testing.T) {
+	s := newSecret([]byte("hunter2"))
+	for _, format := range []string{"%s", "%v", "%+v", "%#v"} {
+		if out := fmt.Sprintf(format, s); bytes.Contains([]byte(out), []byte("hunter2")) {
+			t.Errorf("%s: expected the secret to be hidden, got %q", format, out)
+		}
+	}
+}
+
+// Tests whether the logon payload is valid JSON with the password escaped,
+// and whether printing a secret destroys it.
+func TestLogonPayload(t *testing.T) {
+	for _, password := range []string{"hunter2", `quo"te\back`, "new\nline\t", "ünïcødé"} {
+		b, err := logonPayload(caLogonRequest{Username: "AB12CD", ConnectionNumber: 1}, newSecret([]byte(password)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded map[string]interface{}
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			t.Fatalf("%q: invalid JSON %s: %s", password, b, err)
+		}
+		if decoded["password"] != password || decoded["username"] != "AB12CD" {
+			t.Errorf("%q: unexpected payload %s", password, b)
+		}
+	}
+
+	if _, err := logonPayload(caLogonRequest{}, newSecret([]byte{0xff})); err == nil {
+		t.Error("expected invalid UTF-8 to be rejected")
+	}
+
+	buf := []byte("hunter2")
+	var out bytes.Buffer
+	printSecret(&out, "app = ", newSecret(buf))
+	if out.String() != "app = hunter2\n" || !bytes.Equal(buf, make([]byte, len(buf))) {
+		t.Errorf("expected the secret to be printed and destroyed, got %q and %q", out.String(), buf)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// webhookClient is used for posting notifications. It verifies certificates,
+// since webhooks usually live outside of the company network.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookPayload is posted to the webhook after a request has been handled.
+// It must never contain secrets.
+type webhookPayload struct {
+	RequestID string    `json:"request_id"`
+	Requestor string    `json:"requestor"`
+	Account   string    `json:"account"`
+	Action    string    `json:"action"` // What was done, such as "confirm".
+	Result    string    `json:"result"` // Either "ok" or "failed".
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// newWebhookPayload creates the payload for the outcome of an approval.
+func newWebhookPayload(action string, a caApproval, now time.Time) webhookPayload {
+	p := webhookPayload{
+		RequestID: a.Request.RequestID,
+		Requestor: a.Request.RequestorUserName,
+		Account:   a.Request.AccountDetails.Properties.Name,
+		Action:    action,
+		Result:    "ok",
+		Timestamp: now,
+	}
+	if a.Err != nil {
+		p.Result = "failed"
+		p.Error = a.Err.Error()
+	}
+	return p
+}
+
+// notifyWebhook posts the payload as JSON to the webhook URL.
+func notifyWebhook(client *http.Client, url string, p webhookPayload) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Tests the body posted to the webhook for an approval.
+func TestApproveWebhook(t *testing.T) {
+	var posted []map[string]interface{}
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("unexpected content type '%s'", ct)
+		}
+		body := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		posted = append(posted, body)
+	}))
+	defer webhook.Close()
+
+	defer func() { *flagWebhook = "" }()
+	*flagWebhook = webhook.URL
+
+	api := newTestAPI(t, incomingRequestsHandler(`{"RequestID": "1", "RequestorUserName": "AB12CD", "AccountDetails": {"Properties": {"Name": "root@db01"}}}`))
+	captureOutput(t)
+
+	if err := approveIncoming(api, "AB12CD", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(posted) != 1 {
+		t.Fatalf("expected 1 notification, got %d", len(posted))
+	}
+	expected := map[string]interface{}{
+		"request_id": "1",
+		"requestor":  "AB12CD",
+		"account":    "root@db01",
+		"action":     "confirm",
+		"result":     "ok",
+	}
+	for k, v := range expected {
+		if posted[0][k] != v {
+			t.Errorf("expected %s '%v', got '%v'", k, v, posted[0][k])
+		}
+	}
+	if _, ok := posted[0]["timestamp"]; !ok {
+		t.Error("expected a timestamp")
+	}
+	if _, ok := posted[0]["error"]; ok {
+		t.Error("expected no error for a successful confirmation")
+	}
+}
+
+// Tests whether a failing webhook doesn't abort approving.
+func TestApproveWebhookFailure(t *testing.T) {
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer webhook.Close()
+
+	defer func() { *flagWebhook = "" }()
+	*flagWebhook = webhook.URL
+
+	api := newTestAPI(t, incomingRequestsHandler(mixedRequests))
+	out, errOut := captureOutput(t)
+
+	if err := approveIncoming(api, "AB12CD,EF34GH", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Confirmed: 2, failed: 0, ignored: 1") {
+		t.Errorf("expected both requests to be confirmed, got:\n%s", out)
+	}
+	if !strings.Contains(errOut.String(), "Unable to notify webhook") {
+		t.Errorf("expected the webhook failure to be reported, got:\n%s", errOut)
+	}
+}